@@ -0,0 +1,200 @@
+package modemmanagerexporter
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/mdlayher/modemmanager"
+)
+
+// D-Bus error names which are handled by the exporter.
+const (
+	// serviceUnknownError is returned when ModemManager is not present on the
+	// bus, such as while the daemon is restarting.
+	serviceUnknownError = "org.freedesktop.DBus.Error.ServiceUnknown"
+
+	// Transient errors which may succeed if a call is retried.
+	noReplyError  = "org.freedesktop.DBus.Error.NoReply"
+	timeoutError  = "org.freedesktop.DBus.Error.Timeout"
+	timedOutError = "org.freedesktop.DBus.Error.TimedOut"
+)
+
+// A client wraps a *modemmanager.Client and redials ModemManager when the
+// underlying D-Bus connection appears to have been lost. If the wrapped client
+// is nil, ModemManager is dialed on each use until it becomes available.
+type client struct {
+	mu sync.Mutex
+	c  *modemmanager.Client
+
+	// connected is the time when c was created or last redialed, which
+	// approximates when ModemManager started if it restarts while the
+	// exporter is running.
+	connected time.Time
+
+	// Functions which normally manipulate D-Bus but are also swappable for
+	// tests.
+	now          func() time.Time
+	dial         func(ctx context.Context) (*modemmanager.Client, error)
+	forEachModem func(c *modemmanager.Client, ctx context.Context, fn func(ctx context.Context, m *modemmanager.Modem) error) error
+}
+
+// newClient creates a client which wraps c. c may be nil if ModemManager was
+// not available when the exporter started.
+func newClient(c *modemmanager.Client) *client {
+	var connected time.Time
+	if c != nil {
+		connected = time.Now()
+	}
+
+	return &client{
+		c:            c,
+		connected:    connected,
+		now:          time.Now,
+		dial:         modemmanager.Dial,
+		forEachModem: (*modemmanager.Client).ForEachModem,
+	}
+}
+
+// Version returns the ModemManager version reported by the current client, or
+// empty if ModemManager has never been available.
+func (c *client) Version() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.c == nil {
+		return ""
+	}
+
+	return c.c.Version
+}
+
+// Connected returns the time when the exporter connected to ModemManager,
+// including any reconnections after ModemManager restarts.
+func (c *client) Connected() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.connected
+}
+
+// ForEachModem invokes fn for each modem using the current client. If the
+// D-Bus connection appears to have been lost before any modems were visited,
+// the client is redialed and iteration is retried once.
+func (c *client) ForEachModem(ctx context.Context, fn func(ctx context.Context, m *modemmanager.Modem) error) error {
+	c.mu.Lock()
+	mmc := c.c
+	c.mu.Unlock()
+
+	if mmc == nil {
+		// ModemManager has never been available, so there is no connection
+		// to retry.
+		mmc, err := c.redial(ctx)
+		if err != nil {
+			return err
+		}
+
+		return c.forEachModem(mmc, ctx, fn)
+	}
+
+	var visited bool
+	err := c.forEachModem(mmc, ctx, func(ctx context.Context, m *modemmanager.Modem) error {
+		visited = true
+		return fn(ctx, m)
+	})
+	if err == nil || visited || !isDisconnected(err) {
+		// Retrying after visiting any modems would invoke fn for those modems
+		// a second time, so only retry when no modems have been visited.
+		return err
+	}
+
+	mmc, derr := c.redial(ctx)
+	if derr != nil {
+		// Report the original error; ModemManager is likely still down.
+		return err
+	}
+
+	return c.forEachModem(mmc, ctx, fn)
+}
+
+// Modem returns the modem with the input index using the current client,
+// dialing ModemManager first if it has never been available.
+func (c *client) Modem(ctx context.Context, index int) (*modemmanager.Modem, error) {
+	c.mu.Lock()
+	mmc := c.c
+	c.mu.Unlock()
+
+	if mmc == nil {
+		var err error
+		if mmc, err = c.redial(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	return mmc.Modem(ctx, index)
+}
+
+// redial dials ModemManager and replaces the current client. Any error is
+// wrapped in a *dialError.
+func (c *client) redial(ctx context.Context) (*modemmanager.Client, error) {
+	mmc, err := c.dial(ctx)
+	if err != nil {
+		return nil, &dialError{Err: err}
+	}
+
+	// Note that the previous client is not closed because D-Bus system bus
+	// connections are shared, and the new client may reuse its connection.
+	c.mu.Lock()
+	c.c = mmc
+	c.connected = c.now()
+	c.mu.Unlock()
+
+	return mmc, nil
+}
+
+// A dialError indicates that ModemManager could not be dialed.
+type dialError struct {
+	Err error
+}
+
+// Error implements error.
+func (e *dialError) Error() string { return e.Err.Error() }
+
+// Unwrap implements errors unwrapping.
+func (e *dialError) Unwrap() error { return e.Err }
+
+// isUnreachable reports whether err indicates that ModemManager itself could
+// not be reached, as opposed to a failure while gathering data from it.
+func isUnreachable(err error) bool {
+	var derr *dialError
+	return isDisconnected(err) || errors.As(err, &derr)
+}
+
+// isDisconnected reports whether err indicates that the connection to
+// ModemManager has been lost.
+func isDisconnected(err error) bool {
+	if errors.Is(err, dbus.ErrClosed) {
+		return true
+	}
+
+	var derr dbus.Error
+	return errors.As(err, &derr) && derr.Name == serviceUnknownError
+}
+
+// isTransient reports whether err is a transient D-Bus error which may succeed
+// if the call is retried.
+func isTransient(err error) bool {
+	var derr dbus.Error
+	if !errors.As(err, &derr) {
+		return false
+	}
+
+	switch derr.Name {
+	case noReplyError, timeoutError, timedOutError:
+		return true
+	default:
+		return false
+	}
+}
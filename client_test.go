@@ -0,0 +1,79 @@
+package modemmanagerexporter
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/mdlayher/modemmanager"
+)
+
+func TestClientForEachModemRedial(t *testing.T) {
+	var (
+		dead = &modemmanager.Client{Version: "1.18.0"}
+		live = &modemmanager.Client{Version: "1.20.0"}
+
+		dials int
+	)
+
+	c := &client{
+		c:   dead,
+		now: func() time.Time { return time.Unix(1, 0) },
+		dial: func(_ context.Context) (*modemmanager.Client, error) {
+			dials++
+			return live, nil
+		},
+		forEachModem: func(c *modemmanager.Client, ctx context.Context, fn func(ctx context.Context, m *modemmanager.Modem) error) error {
+			if c == dead {
+				return dbus.ErrClosed
+			}
+
+			return fn(ctx, &modemmanager.Modem{DeviceIdentifier: "foo"})
+		},
+	}
+
+	var ids []string
+	err := c.ForEachModem(context.Background(), func(_ context.Context, m *modemmanager.Modem) error {
+		ids = append(ids, m.DeviceIdentifier)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to iterate modems: %v", err)
+	}
+
+	if dials != 1 {
+		t.Fatalf("expected exactly one redial, but got: %d", dials)
+	}
+	if len(ids) != 1 || ids[0] != "foo" {
+		t.Fatalf("unexpected modems visited: %v", ids)
+	}
+	if v := c.Version(); v != live.Version {
+		t.Fatalf("unexpected version: %q", v)
+	}
+	if !c.Connected().Equal(time.Unix(1, 0)) {
+		t.Fatalf("unexpected connected time: %v", c.Connected())
+	}
+}
+
+func TestClientForEachModemNoRedial(t *testing.T) {
+	errFailed := errors.New("some other failure")
+
+	c := &client{
+		c: &modemmanager.Client{},
+		dial: func(_ context.Context) (*modemmanager.Client, error) {
+			panic("should not redial")
+		},
+		forEachModem: func(_ *modemmanager.Client, _ context.Context, _ func(ctx context.Context, m *modemmanager.Modem) error) error {
+			return errFailed
+		},
+	}
+
+	err := c.ForEachModem(context.Background(), func(_ context.Context, _ *modemmanager.Modem) error {
+		return nil
+	})
+	if !errors.Is(err, errFailed) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -4,66 +4,533 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
 	"time"
 
+	kitlog "github.com/go-kit/log"
 	"github.com/mdlayher/modemmanager"
 	modemmanagerexporter "github.com/mdlayher/modemmanager_exporter"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/exporter-toolkit/web"
+)
+
+// Build metadata, set at link time using:
+//
+//	go build -ldflags "-X main.version=v1.0.0 -X main.revision=$(git rev-parse HEAD)"
+var (
+	version  = "unknown"
+	revision = "unknown"
 )
 
 func main() {
 	var (
-		addr = flag.String("addr", ":9539", "address for ModemManager exporter")
-		rate = flag.Duration("rate", 5*time.Second, "how frequently ModemManager should poll each modem for its extended signal strength data")
+		addr         = flag.String("addr", ":9539", "address for ModemManager exporter: a TCP address, or a Unix socket path prefixed with unix:, such as unix:/run/modemmanager_exporter.sock")
+		path         = flag.String("web.telemetry-path", "/metrics", "URL path under which to serve Prometheus metrics")
+		readTimeout  = flag.Duration("web.read-timeout", 10*time.Second, "the maximum amount of time allowed to read each HTTP request")
+		writeTimeout = flag.Duration("web.write-timeout", 30*time.Second, "the maximum amount of time allowed to write each HTTP response; must be larger than -scrape.timeout")
+
+		rate         = flag.Duration("rate", 5*time.Second, "how frequently ModemManager should poll each modem for its extended signal strength data")
+		signalSetup  = flag.Bool("signal.setup", true, "whether to configure the extended signal strength refresh rate for each modem; disable to avoid modifying modem configuration, in which case -rate is ignored")
+		signalWindow = flag.Int("signal.window", 0, "optional: the number of most recent scrapes over which the minimum, maximum, and average LTE RSRP of each modem are exported")
+		signalRaw    = flag.Bool("signal.raw", false, "whether to export extended signal strength metrics even for modems which are not registered with a network or which report all zero signal data")
+
+		dbusTimeout   = flag.Duration("dbus.timeout", 30*time.Second, "the maximum amount of time to wait for ModemManager to become available at startup")
+		dbusOptional  = flag.Bool("dbus.optional", false, "whether to start even if ModemManager is not available within -dbus.timeout, reporting modemmanager_up 0 until ModemManager appears; for hosts where a modem is optional")
+		scrapeTimeout = flag.Duration("scrape.timeout", 5*time.Second, "the maximum amount of time allowed to gather metrics from ModemManager for each scrape")
+		cacheInterval = flag.Duration("cache.interval", 0, "optional: how long metrics gathered from ModemManager are cached and served to subsequent scrapes, limiting D-Bus load when multiple Prometheus servers scrape the exporter")
+		modemTimeout  = flag.String("scrape.modem-timeouts", "", "optional: comma-separated list of device_id=timeout pairs which override -scrape.timeout for individual modems, such as foo=10s")
+		callTimeout   = flag.Duration("scrape.call-timeout", 0, "optional: the maximum amount of time allowed for each individual call to a modem during a scrape")
+		concurrency   = flag.Int("scrape.concurrency", 1, "the maximum number of modems to scrape concurrently")
+		retries       = flag.Int("scrape.retries", 2, "the number of times a call to a modem is retried after a transient D-Bus error")
+		staleGrace    = flag.Duration("scrape.stale-grace", 0, "optional: how long the last good metrics for a modem are exported with a stale=\"true\" label after gathering data from it fails; if set, the affected metrics always carry a stale label")
+		include       = flag.String("modem.include", "", "optional: comma-separated list of modem device_id label values or regular expressions; only matching modems are exported")
+		exclude       = flag.String("modem.exclude", "", "optional: comma-separated list of modem device_id label values or regular expressions; matching modems are not exported")
+		metricID      = flag.String("metric.id", "device", "the modem identifier used as the device_id label value: device for the ModemManager device identifier, or equipment for the equipment identifier such as the IMEI")
+		dropLabels    = flag.String("info.drop-labels", "", "optional: comma-separated list of labels to omit from modemmanager_modem_info, such as firmware,model; device_id is always kept")
+
+		collectBearers     = flag.Bool("collect.bearers", true, "whether to gather modem bearer metrics")
+		collectNetworkTime = flag.Bool("collect.network-time", true, "whether to query each modem for the current network time; disable for modems which do not support it")
+		collectPorts       = flag.Bool("collect.ports", true, "whether to gather modem port metrics")
+		collectPowerState  = flag.Bool("collect.power-state", true, "whether to gather modem power state metrics")
+		collectSignal      = flag.Bool("collect.signal", true, "whether to gather modem extended signal strength metrics and configure the signal refresh rate")
+
+		dryRun = flag.Bool("dry-run", false, "print the properties of each modem and the metrics gathered by a single scrape to stdout, and then exit without serving HTTP")
+
+		webConfig = flag.String("web.config.file", "", "optional: path to an exporter-toolkit web configuration file which enables TLS and/or basic authentication")
 	)
 
+	labels := make(labelsFlag)
+	flag.Var(labels, "label", "optional: a constant name=value label added to every exported metric, such as site=foo; may be repeated")
+
 	flag.Parse()
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+	var useEquipmentID bool
+	switch *metricID {
+	case "device":
+	case "equipment":
+		useEquipmentID = true
+	default:
+		log.Fatalf("invalid -metric.id %q: must be one of device or equipment", *metricID)
+	}
 
-	// Keep the D-Bus connection open for the lifetime of the program, and use
-	// it immediately to start polling the modems for signal status.
-	c, err := modemmanager.Dial(ctx)
-	if err != nil {
-		log.Fatalf("failed to connect to ModemManager: %v", err)
+	if err := checkPath(*path); err != nil {
+		log.Fatalf("invalid -web.telemetry-path: %v", err)
 	}
-	defer c.Close()
 
-	err = c.ForEachModem(ctx, func(ctx context.Context, m *modemmanager.Modem) error {
-		log.Printf("modem %d: %q", m.Index, m.Model)
-		if err := m.SignalSetup(ctx, *rate); err != nil {
-			return fmt.Errorf("failed to set signal refresh rate: %v", err)
+	// A scrape which outlives the write timeout cannot be served, so leave
+	// some headroom beyond the scrape timeout.
+	if *writeTimeout <= *scrapeTimeout {
+		log.Fatalf("-web.write-timeout (%s) must be larger than -scrape.timeout (%s)", *writeTimeout, *scrapeTimeout)
+	}
+
+	modemTimeouts := parseModemTimeouts(*modemTimeout)
+	for id, t := range modemTimeouts {
+		if *writeTimeout <= t {
+			log.Fatalf("-web.write-timeout (%s) must be larger than the -scrape.modem-timeouts timeout for %q (%s)", *writeTimeout, id, t)
 		}
+	}
 
-		return nil
-	})
+	// Check the web configuration before connecting to ModemManager so that
+	// mistakes are reported immediately.
+	if err := web.Validate(*webConfig); err != nil {
+		log.Fatalf("invalid -web.config.file: %v", err)
+	}
+
+	// Keep the D-Bus connection open for the lifetime of the program.
+	dctx, dcancel := context.WithTimeout(context.Background(), *dbusTimeout)
+	defer dcancel()
+
+	c, err := dial(dctx)
 	if err != nil {
-		log.Fatalf("failed to configure modems: %v", err)
+		if !*dbusOptional || *dryRun {
+			log.Fatalf("failed to connect to ModemManager: %v", err)
+		}
+
+		// Serve anyway; the handlers dial ModemManager on each request until
+		// it becomes available.
+		log.Printf("ModemManager is not available, continuing without it: %v", err)
+		c = nil
+	}
+
+	*rate = signalRate(*rate, *signalSetup, *collectSignal)
+
+	cfg := &modemmanagerexporter.Config{
+		Timeout:          *scrapeTimeout,
+		ModemTimeouts:    modemTimeouts,
+		CallTimeout:      *callTimeout,
+		CacheInterval:    *cacheInterval,
+		StaleGracePeriod: *staleGrace,
+		SignalRate:       *rate,
+		SignalWindow:     *signalWindow,
+		RawSignal:        *signalRaw,
+		Concurrency:      *concurrency,
+		Retries:          *retries,
+		DisableCollectors: disabledCollectors(map[string]bool{
+			"bearers":      *collectBearers,
+			"network_time": *collectNetworkTime,
+			"ports":        *collectPorts,
+			"power_state":  *collectPowerState,
+			"signal":       *collectSignal,
+		}),
+		Logger:         log.Default(),
+		DropInfoLabels: splitList(*dropLabels),
+		IncludeModems:  modemRegexp("-modem.include", *include),
+		ExcludeModems:  modemRegexp("-modem.exclude", *exclude),
+		UseEquipmentID: useEquipmentID,
+		Labels:         labels,
+	}
+
+	// Constant labels which conflict with the exporter's metric labels would
+	// otherwise fail every scrape, so check them before serving.
+	if err := prometheus.NewRegistry().Register(modemmanagerexporter.NewCollector(c, cfg)); err != nil {
+		log.Fatalf("invalid -label: %v", err)
+	}
+
+	if *dryRun {
+		err := dryRunScrape(c, cfg)
+		_ = c.Close()
+		if err != nil {
+			log.Fatalf("dry run failed: %v", err)
+		}
+
+		return
+	}
+
+	// Log the modems present at startup. The collector configures the signal
+	// refresh rate of each modem on its first scrape, and reports any failure
+	// to do so as a metric.
+	if c != nil {
+		if err := logModems(c); err != nil {
+			log.Printf("failed to list modems: %v", err)
+		}
 	}
 
 	// Set up the Prometheus registry and exporter handler.
 	reg := prometheus.NewPedanticRegistry()
-	reg.MustRegister(
+	prometheus.WrapRegistererWith(prometheus.Labels(labels), reg).MustRegister(
 		collectors.NewBuildInfoCollector(),
+		modemmanagerexporter.NewBuildInfoCollector(version, revision),
 		collectors.NewGoCollector(),
 		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
 	)
 
+	// The metrics and JSON handlers share a single exporter so that each modem
+	// is only tracked and configured once.
+	e := modemmanagerexporter.NewExporter(c, cfg)
+
 	mux := http.NewServeMux()
-	mux.Handle("/metrics", modemmanagerexporter.NewHandler(reg, c))
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		http.Redirect(w, r, "/metrics", http.StatusMovedPermanently)
-	})
+	mux.Handle(*path, e.Handler(reg))
+	mux.Handle("/healthz", modemmanagerexporter.NewHealthHandler(c))
+	mux.Handle("/modems.json", e.JSONHandler())
+	mux.Handle("/", modemmanagerexporter.NewLandingHandler(c, *path, version, revision))
+
+	srv := &http.Server{
+		Handler:      mux,
+		ReadTimeout:  *readTimeout,
+		WriteTimeout: *writeTimeout,
+	}
+
+	l, err := listen(*addr)
+	if err != nil {
+		log.Fatalf("failed to listen: %v", err)
+	}
+
+	// The listener is closed by srv, which also removes any Unix socket. The
+	// web configuration file enables TLS and basic authentication, if set.
+	flags := &web.FlagConfig{
+		WebListenAddresses: &[]string{*addr},
+		WebSystemdSocket:   new(bool),
+		WebConfigFile:      webConfig,
+	}
+	logger := kitlog.NewLogfmtLogger(kitlog.NewSyncWriter(os.Stderr))
+	run := func() error { return web.Serve(l, srv, flags, logger) }
+
+	// Stop serving and drain any in-flight scrapes on SIGINT or SIGTERM.
+	sctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	log.Printf("starting ModemManager exporter on %q", *addr)
 
-	if err := http.ListenAndServe(*addr, mux); err != nil {
-		log.Fatalf("cannot start ModemManager exporter: %v", err)
+	serr := serve(sctx, srv, run)
+
+	// Close the D-Bus connection only after all scrapes have completed.
+	if c != nil {
+		if err := c.Close(); err != nil {
+			log.Printf("failed to close ModemManager connection: %v", err)
+		}
+	}
+
+	if serr != nil {
+		log.Fatalf("failed to serve ModemManager exporter: %v", serr)
+	}
+
+	log.Println("stopped ModemManager exporter")
+}
+
+// dryRunScrape prints the properties of each modem and the metrics gathered by
+// a single scrape to stdout, returning an error if the scrape fails.
+func dryRunScrape(c *modemmanager.Client, cfg *modemmanagerexporter.Config) error {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+	defer cancel()
+
+	fmt.Printf("ModemManager %s\n", c.Version)
+
+	err := c.ForEachModem(ctx, func(_ context.Context, m *modemmanager.Modem) error {
+		fmt.Printf("\nmodem %d:\n", m.Index)
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
+		for _, p := range [][2]string{
+			{"device identifier", m.DeviceIdentifier},
+			{"equipment identifier", m.EquipmentIdentifier},
+			{"manufacturer", m.Manufacturer},
+			{"model", m.Model},
+			{"revision", m.Revision},
+			{"hardware revision", m.HardwareRevision},
+			{"device", m.Device},
+			{"plugin", m.Plugin},
+			{"primary port", m.PrimaryPort},
+			{"state", m.State.String()},
+			{"power state", m.PowerState.String()},
+		} {
+			fmt.Fprintf(tw, "  %s:\t%s\n", p[0], p[1])
+		}
+		for _, p := range m.Ports {
+			fmt.Fprintf(tw, "  port:\t%s (%s)\n", p.Name, p.Type)
+		}
+
+		return tw.Flush()
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list modems: %v", err)
+	}
+
+	// A dry run must not modify the modems, so never configure their signal
+	// refresh rate.
+	dcfg := *cfg
+	dcfg.SignalRate = 0
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(modemmanagerexporter.NewCollector(c, &dcfg))
+
+	// Print any metrics which were gathered even if the scrape failed.
+	mfs, gerr := reg.Gather()
+
+	fmt.Println()
+	enc := expfmt.NewEncoder(os.Stdout, expfmt.FmtText)
+	for _, mf := range mfs {
+		if err := enc.Encode(mf); err != nil {
+			return fmt.Errorf("failed to encode metrics: %v", err)
+		}
+	}
+
+	if gerr != nil {
+		return fmt.Errorf("failed to gather metrics: %v", gerr)
+	}
+
+	// Errors which occur while gathering data from individual modems do not
+	// fail the scrape, but they are counted.
+	for _, mf := range mfs {
+		if mf.GetName() != "modemmanager_scrape_errors_total" {
+			continue
+		}
+
+		if n := mf.GetMetric()[0].GetCounter().GetValue(); n > 0 {
+			return fmt.Errorf("%d error(s) occurred while gathering data from modems", int(n))
+		}
+	}
+
+	return nil
+}
+
+// reservedPaths are the URL paths served by the exporter's other handlers.
+var reservedPaths = []string{"/", "/healthz", "/modems.json"}
+
+// checkPath verifies that path can be used to serve metrics.
+func checkPath(path string) error {
+	if !strings.HasPrefix(path, "/") {
+		return fmt.Errorf("path %q must begin with /", path)
+	}
+
+	for _, p := range reservedPaths {
+		if path == p {
+			return fmt.Errorf("path %q is reserved for another handler", path)
+		}
+	}
+
+	return nil
+}
+
+// signalRate returns the extended signal strength refresh rate configured for
+// each modem. The rate is zero, leaving the modems unmodified, when signal
+// setup or the signal collector is disabled; in the former case the exporter
+// only reports the signal data the modems already provide.
+func signalRate(rate time.Duration, setup, collect bool) time.Duration {
+	if !setup || !collect {
+		return 0
+	}
+
+	return rate
+}
+
+// logModems logs each modem present at startup.
+func logModems(c *modemmanager.Client) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return c.ForEachModem(ctx, func(_ context.Context, m *modemmanager.Modem) error {
+		log.Printf("modem %d: %q", m.Index, m.Model)
+		return nil
+	})
+}
+
+// listen listens on addr, which is either a TCP address or a Unix socket path
+// prefixed with "unix:".
+func listen(addr string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, "unix:") {
+		return net.Listen("tcp", addr)
+	}
+
+	// Remove a socket left behind if the exporter previously did not shut
+	// down cleanly, but never any other type of file.
+	path := strings.TrimPrefix(addr, "unix:")
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket: %v", err)
+		}
+	}
+
+	return net.Listen("unix", path)
+}
+
+// shutdownTimeout is the maximum amount of time allowed to drain in-flight
+// HTTP requests on shutdown.
+const shutdownTimeout = 10 * time.Second
+
+// serve runs srv using listen until ctx is canceled, and then gracefully shuts
+// down srv to drain any in-flight requests.
+func serve(ctx context.Context, srv *http.Server, listen func() error) error {
+	errC := make(chan error, 1)
+	go func() { errC <- listen() }()
+
+	select {
+	case err := <-errC:
+		// The server stopped without a shutdown request, likely because it
+		// failed to listen.
+		return err
+	case <-ctx.Done():
+	}
+
+	sctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := srv.Shutdown(sctx); err != nil {
+		return fmt.Errorf("failed to shut down HTTP server: %v", err)
+	}
+
+	// After Shutdown, listen always returns http.ErrServerClosed.
+	if err := <-errC; !errors.Is(err, http.ErrServerClosed) {
+		return err
 	}
+
+	return nil
+}
+
+// dial dials ModemManager, retrying with exponential backoff until it succeeds
+// or ctx is canceled. This allows the exporter to start cleanly while
+// ModemManager is still starting at boot.
+func dial(ctx context.Context) (*modemmanager.Client, error) {
+	const maxDelay = 5 * time.Second
+
+	delay := 250 * time.Millisecond
+	for {
+		c, err := modemmanager.Dial(ctx)
+		if err == nil {
+			return c, nil
+		}
+
+		log.Printf("failed to connect to ModemManager, retrying in %s: %v", delay, err)
+
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(delay):
+		}
+
+		if delay *= 2; delay > maxDelay {
+			delay = maxDelay
+		}
+	}
+}
+
+// disabledCollectors returns the names of the collectors which are not enabled
+// in collectors.
+func disabledCollectors(collectors map[string]bool) []string {
+	var disabled []string
+	for name, enabled := range collectors {
+		if !enabled {
+			disabled = append(disabled, name)
+		}
+	}
+
+	return disabled
+}
+
+// splitList splits a comma-separated flag value into its elements, returning
+// nil for an empty string.
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+
+	return strings.Split(s, ",")
+}
+
+// modemRegexp compiles a comma-separated flag value into a regular expression
+// which must fully match a modem device identifier, returning nil for an empty
+// string.
+func modemRegexp(name, s string) *regexp.Regexp {
+	ss := splitList(s)
+	if len(ss) == 0 {
+		return nil
+	}
+
+	re, err := regexp.Compile("^(?:" + strings.Join(ss, "|") + ")$")
+	if err != nil {
+		log.Fatalf("failed to parse %s: %v", name, err)
+	}
+
+	return re
+}
+
+// parseModemTimeouts parses a comma-separated list of device_id=timeout pairs,
+// returning nil for an empty string.
+func parseModemTimeouts(s string) map[string]time.Duration {
+	ss := splitList(s)
+	if len(ss) == 0 {
+		return nil
+	}
+
+	timeouts := make(map[string]time.Duration, len(ss))
+	for _, kv := range ss {
+		id, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			log.Fatalf("invalid -scrape.modem-timeouts entry %q: must be of the form device_id=timeout", kv)
+		}
+
+		t, err := time.ParseDuration(v)
+		if err != nil || t <= 0 {
+			log.Fatalf("invalid -scrape.modem-timeouts timeout for %q: %q", id, v)
+		}
+
+		timeouts[id] = t
+	}
+
+	return timeouts
+}
+
+// A labelsFlag is a flag.Value which accumulates repeated name=value constant
+// labels.
+type labelsFlag map[string]string
+
+// String implements flag.Value.
+func (l labelsFlag) String() string {
+	ss := make([]string, 0, len(l))
+	for k, v := range l {
+		ss = append(ss, k+"="+v)
+	}
+
+	sort.Strings(ss)
+	return strings.Join(ss, ",")
+}
+
+// Set implements flag.Value.
+func (l labelsFlag) Set(s string) error {
+	k, v, ok := strings.Cut(s, "=")
+	if !ok {
+		return fmt.Errorf("label %q must be of the form name=value", s)
+	}
+	if !model.LabelName(k).IsValid() {
+		return fmt.Errorf("invalid label name %q", k)
+	}
+	if _, ok := l[k]; ok {
+		return fmt.Errorf("duplicate label %q", k)
+	}
+
+	l[k] = v
+	return nil
 }
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "exporter.sock")
+
+	l, err := listen("unix:" + path)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, "modemmanager_up 1\n")
+	})
+	srv := &http.Server{Handler: mux}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errC := make(chan error, 1)
+	go func() { errC <- serve(ctx, srv, func() error { return srv.Serve(l) }) }()
+
+	c := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		},
+	}
+
+	res, err := c.Get("http://unix/metrics")
+	if err != nil {
+		t.Fatalf("failed to fetch metrics: %v", err)
+	}
+	defer res.Body.Close()
+
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("failed to read body: %v", err)
+	}
+	if got := string(b); got != "modemmanager_up 1\n" {
+		t.Fatalf("unexpected body: %q", got)
+	}
+
+	// Shutting down the server must remove the socket.
+	cancel()
+	if err := <-errC; err != nil {
+		t.Fatalf("failed to serve: %v", err)
+	}
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected socket to be removed, but got: %v", err)
+	}
+}
+
+func TestSignalRate(t *testing.T) {
+	tests := []struct {
+		name           string
+		setup, collect bool
+		want           time.Duration
+	}{
+		{
+			name:    "enabled",
+			setup:   true,
+			collect: true,
+			want:    5 * time.Second,
+		},
+		{
+			name:    "setup disabled",
+			collect: true,
+		},
+		{
+			name:  "signal collector disabled",
+			setup: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := signalRate(5*time.Second, tt.setup, tt.collect); got != tt.want {
+				t.Fatalf("unexpected signal rate: want %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestCheckPath(t *testing.T) {
+	tests := []struct {
+		path string
+		ok   bool
+	}{
+		{path: "/metrics", ok: true},
+		{path: "/foo/metrics", ok: true},
+		{path: "metrics"},
+		{path: ""},
+		{path: "/"},
+		{path: "/healthz"},
+		{path: "/modems.json"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			err := checkPath(tt.path)
+			if tt.ok && err != nil {
+				t.Fatalf("failed to check path: %v", err)
+			}
+			if !tt.ok && err == nil {
+				t.Fatal("expected an error, but none occurred")
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package modemmanagerexporter
+
+import (
+	"context"
+	"runtime"
+
+	"github.com/mdlayher/metricslite"
+	"github.com/mdlayher/modemmanager"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var _ prometheus.Collector = &promCollector{}
+
+// A promCollector is a prometheus.Collector which exports the metrics gathered
+// by a collector.
+type promCollector struct {
+	ctx   context.Context
+	c     *collector
+	descs map[string]promDesc
+}
+
+// A promDesc stores information about a Prometheus const metric.
+type promDesc struct {
+	desc  *prometheus.Desc
+	value prometheus.ValueType
+}
+
+// NewCollector returns a prometheus.Collector which gathers metrics using a
+// ModemManager client. If cfg is nil, a default configuration is used.
+func NewCollector(c *modemmanager.Client, cfg *Config) prometheus.Collector {
+	return newPromCollector(newCollector(c, cfg))
+}
+
+// NewBuildInfoCollector returns a prometheus.Collector which exports the
+// exporter's build version and revision, typically set at link time, along
+// with the Go version used to build it.
+func NewBuildInfoCollector(version, revision string) prometheus.Collector {
+	return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: mmExporterBuildInfo,
+		Help: "Metadata about the ModemManager exporter build.",
+		ConstLabels: prometheus.Labels{
+			"version":   version,
+			"revision":  revision,
+			"goversion": runtime.Version(),
+		},
+	}, func() float64 { return 1.0 })
+}
+
+// newPromCollector creates a promCollector which exports metrics from c.
+func newPromCollector(c *collector) *promCollector {
+	pc := &promCollector{
+		ctx:   context.Background(),
+		c:     c,
+		descs: make(map[string]promDesc),
+	}
+
+	// Descriptors are only registered here, so no locking is necessary when
+	// they are accessed later.
+	c.register(pc)
+	return pc
+}
+
+// withContext returns a copy of pc which cancels any in-flight calls to
+// ModemManager when ctx is canceled.
+func (pc *promCollector) withContext(ctx context.Context) *promCollector {
+	pc2 := *pc
+	pc2.ctx = ctx
+	return &pc2
+}
+
+// ConstCounter implements registerer.
+func (pc *promCollector) ConstCounter(name, help string, labelNames ...string) {
+	pc.descs[name] = promDesc{
+		desc:  prometheus.NewDesc(name, help, labelNames, pc.c.labels),
+		value: prometheus.CounterValue,
+	}
+}
+
+// ConstGauge implements registerer.
+func (pc *promCollector) ConstGauge(name, help string, labelNames ...string) {
+	pc.descs[name] = promDesc{
+		desc:  prometheus.NewDesc(name, help, labelNames, pc.c.labels),
+		value: prometheus.GaugeValue,
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (pc *promCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range pc.descs {
+		ch <- d.desc
+	}
+
+	pc.c.callDuration.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (pc *promCollector) Collect(ch chan<- prometheus.Metric) {
+	// Report the cumulative histogram of call durations observed since the
+	// exporter started.
+	defer pc.c.callDuration.Collect(ch)
+
+	metrics := make(map[string]func(float64, ...string), len(pc.descs))
+	for name, d := range pc.descs {
+		// Shadow d for each closure.
+		d := d
+		metrics[name] = func(value float64, labels ...string) {
+			ch <- prometheus.MustNewConstMetric(d.desc, d.value, value, labels...)
+		}
+	}
+
+	err := pc.c.onScrapeContext(pc.ctx, metrics)
+	if err == nil {
+		return
+	}
+
+	// Scrape failed, try to report more information.
+	serr, ok := err.(*metricslite.ScrapeError)
+	if !ok {
+		// Cannot report on error!
+		return
+	}
+
+	d, ok := pc.descs[serr.Metric]
+	if !ok {
+		panicf("modemmanager_exporter: *ScrapeError contained non-existent metric %q", serr.Metric)
+	}
+
+	ch <- prometheus.NewInvalidMetric(d.desc, serr.Err)
+}
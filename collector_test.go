@@ -0,0 +1,201 @@
+package modemmanagerexporter
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mdlayher/modemmanager"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestCollectorPedanticRegistry(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		ok   bool
+	}{
+		{
+			name: "OK",
+			ok:   true,
+		},
+		{
+			name: "error",
+			err:  errors.New("D-Bus failure"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testCollector(nil)
+			c.version = func() string { return "1.20.0" }
+			c.forEachModem = func(_ context.Context, _ func(context.Context, *modemmanager.Modem) error) error {
+				return tt.err
+			}
+
+			reg := prometheus.NewPedanticRegistry()
+			if err := reg.Register(newPromCollector(c)); err != nil {
+				t.Fatalf("failed to register collector: %v", err)
+			}
+
+			mfs, err := reg.Gather()
+			if tt.ok && err != nil {
+				t.Fatalf("failed to gather metrics: %v", err)
+			}
+			if !tt.ok && err == nil {
+				t.Fatal("expected an error, but none occurred")
+			}
+
+			var names []string
+			for _, mf := range mfs {
+				names = append(names, mf.GetName())
+			}
+
+			// Only the per-scrape metrics are present without modems, and the
+			// ModemManager metrics are omitted when the scrape fails.
+			want := []string{
+				mmScrapeDuration,
+				mmScrapeErrors,
+				mmScrapeSuccess,
+				mmSignalRefreshRate,
+				mmUp,
+			}
+			if tt.ok {
+				want = []string{
+					mmInfo,
+					mmModemsTotal,
+					mmScrapeDuration,
+					mmScrapeErrors,
+					mmScrapeSuccess,
+					mmSignalRefreshRate,
+					mmStartTimestamp,
+					mmUp,
+				}
+			}
+
+			if diff := cmp.Diff(want, names); diff != "" {
+				t.Fatalf("unexpected metric families (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCollectorCallDuration(t *testing.T) {
+	c := testCollector(&Config{SignalRate: time.Second})
+	fakeModems(c, &modemmanager.Modem{DeviceIdentifier: "foo"})
+
+	reg := prometheus.NewPedanticRegistry()
+	if err := reg.Register(newPromCollector(c)); err != nil {
+		t.Fatalf("failed to register collector: %v", err)
+	}
+
+	// Scrape twice so each method is observed twice, except for the signal
+	// setup which only occurs once per modem.
+	var mfs []*dto.MetricFamily
+	for i := 0; i < 2; i++ {
+		var err error
+		mfs, err = reg.Gather()
+		if err != nil {
+			t.Fatalf("failed to gather metrics: %v", err)
+		}
+	}
+
+	got := make(map[string]uint64)
+	for _, mf := range mfs {
+		if mf.GetName() != mmDBusCallDuration {
+			continue
+		}
+
+		for _, m := range mf.GetMetric() {
+			got[m.GetLabel()[0].GetValue()] = m.GetHistogram().GetSampleCount()
+		}
+	}
+
+	want := map[string]uint64{
+		"Bearers":        2,
+		"GetNetworkTime": 2,
+		"Signal":         2,
+		"SignalSetup":    1,
+	}
+
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("unexpected call duration sample counts (-want +got):\n%s", diff)
+	}
+}
+
+func TestCollectorLabels(t *testing.T) {
+	c := testCollector(&Config{
+		SignalRate: time.Second,
+		Labels:     map[string]string{"site": "foo"},
+	})
+	c.version = func() string { return "1.20.0" }
+	fakeModems(c, &modemmanager.Modem{DeviceIdentifier: "bar"})
+
+	reg := prometheus.NewPedanticRegistry()
+	if err := reg.Register(newPromCollector(c)); err != nil {
+		t.Fatalf("failed to register collector: %v", err)
+	}
+
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("failed to gather metrics: %v", err)
+	}
+
+	// Every series, including the call durations, must carry the constant
+	// labels.
+	var n int
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			n++
+
+			var site string
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "site" {
+					site = l.GetValue()
+				}
+			}
+
+			if diff := cmp.Diff("foo", site); diff != "" {
+				t.Fatalf("unexpected site label for %q (-want +got):\n%s", mf.GetName(), diff)
+			}
+		}
+	}
+
+	if n == 0 {
+		t.Fatal("no series were gathered")
+	}
+}
+
+func TestBuildInfoCollector(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	if err := reg.Register(NewBuildInfoCollector("v1.0.0", "deadbeef")); err != nil {
+		t.Fatalf("failed to register collector: %v", err)
+	}
+
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("failed to gather metrics: %v", err)
+	}
+	if len(mfs) != 1 || mfs[0].GetName() != mmExporterBuildInfo {
+		t.Fatalf("unexpected metric families: %v", mfs)
+	}
+
+	got := make(map[string]string)
+	for _, l := range mfs[0].GetMetric()[0].GetLabel() {
+		got[l.GetName()] = l.GetValue()
+	}
+
+	want := map[string]string{
+		"goversion": runtime.Version(),
+		"revision":  "deadbeef",
+		"version":   "v1.0.0",
+	}
+
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("unexpected build info labels (-want +got):\n%s", diff)
+	}
+}
@@ -3,7 +3,13 @@ package modemmanagerexporter
 import (
 	"context"
 	"fmt"
+	"io"
+	"log"
 	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/mdlayher/metricslite"
@@ -14,42 +20,462 @@ import (
 
 const (
 	// Prometheus metric names.
-	mmInfo                  = "modemmanager_info"
-	mmModemInfo             = "modemmanager_modem_info"
-	mmModemNetworkPortInfo  = "modemmanager_modem_network_port_info"
-	mmModemNetworkTimestamp = "modemmanager_network_timestamp_seconds"
-	mmModemPowerState       = "modemmanager_modem_power_state"
-	mmModemState            = "modemmanager_modem_state"
-	mmModemSignalLTERSRQ    = "modemmanager_modem_signal_lte_rsrq_db"
-	mmModemSignalLTERSRP    = "modemmanager_modem_signal_lte_rsrp_dbm"
-	mmModemSignalLTERSSI    = "modemmanager_modem_signal_lte_rssi_dbm"
-	mmModemSignalLTESNR     = "modemmanager_modem_signal_lte_snr_db"
+	mmInfo                       = "modemmanager_info"
+	mmModemBearerAddressInfo     = "modemmanager_modem_bearer_address_info"
+	mmDBusCallDuration           = "modemmanager_dbus_call_duration_seconds"
+	mmExporterBuildInfo          = "modemmanager_exporter_build_info"
+	mmModemBearerConnected       = "modemmanager_modem_bearer_connected"
+	mmModemBearerDuration        = "modemmanager_modem_bearer_duration_seconds_total"
+	mmModemBearerDNSInfo         = "modemmanager_modem_bearer_dns_info"
+	mmModemBearerInfo            = "modemmanager_modem_bearer_info"
+	mmModemBearerMTU             = "modemmanager_modem_bearer_mtu_bytes"
+	mmModemBearerRXBytes         = "modemmanager_modem_bearer_rx_bytes_total"
+	mmModemBearerTXBytes         = "modemmanager_modem_bearer_tx_bytes_total"
+	mmModemBearersTotal          = "modemmanager_modem_bearers_total"
+	mmModemConnected             = "modemmanager_modem_connected"
+	mmModemEnabled               = "modemmanager_modem_enabled"
+	mmModemInfo                  = "modemmanager_modem_info"
+	mmModemLastScrape            = "modemmanager_modem_last_scrape_timestamp_seconds"
+	mmModemNetworkPortInfo       = "modemmanager_modem_network_port_info"
+	mmModemNetworkTimeSkew       = "modemmanager_modem_network_time_skew_seconds"
+	mmModemNetworkTimestamp      = "modemmanager_network_timestamp_seconds"
+	mmModemPortInfo              = "modemmanager_modem_port_info"
+	mmModemPowerState            = "modemmanager_modem_power_state"
+	mmModemPowerStateTransitions = "modemmanager_modem_power_state_transitions_total"
+	mmModemPrimaryPortInfo       = "modemmanager_modem_primary_port_info"
+	mmModemScrapeError           = "modemmanager_modem_scrape_error"
+	mmModemScrapes               = "modemmanager_modem_scrapes_total"
+	mmModemState                 = "modemmanager_modem_state"
+	mmModemStateChanged          = "modemmanager_modem_state_changed_timestamp_seconds"
+	mmModemSignalLTERSRQ         = "modemmanager_modem_signal_lte_rsrq_db"
+	mmModemSignalLTERSRQRatio    = "modemmanager_modem_signal_lte_rsrq_ratio"
+	mmModemSignalLTERSRP         = "modemmanager_modem_signal_lte_rsrp_dbm"
+	mmModemSignalLTERSRPAvg      = "modemmanager_modem_signal_lte_rsrp_avg_dbm"
+	mmModemSignalLTERSRPMax      = "modemmanager_modem_signal_lte_rsrp_max_dbm"
+	mmModemSignalLTERSRPMin      = "modemmanager_modem_signal_lte_rsrp_min_dbm"
+	mmModemSignalLTERSRPRatio    = "modemmanager_modem_signal_lte_rsrp_ratio"
+	mmModemSignalLTERSSI         = "modemmanager_modem_signal_lte_rssi_dbm"
+	mmModemSignalLTESNR          = "modemmanager_modem_signal_lte_snr_db"
+	mmModemSignalLost            = "modemmanager_modem_signal_lost_total"
+	mmModemSignalPollingActive   = "modemmanager_modem_signal_polling_active"
+	mmModemSignalSetupOK         = "modemmanager_modem_signal_setup_ok"
+	mmModemSignalSetupRate       = "modemmanager_modem_signal_setup_rate_seconds"
+	mmModemsTotal                = "modemmanager_modems_total"
+	mmScrapeDuration             = "modemmanager_scrape_duration_seconds"
+	mmScrapeErrors               = "modemmanager_scrape_errors_total"
+	mmScrapeSuccess              = "modemmanager_scrape_success"
+	mmSignalRefreshRate          = "modemmanager_signal_refresh_rate_seconds"
+	mmStartTimestamp             = "modemmanager_start_timestamp_seconds"
+	mmUp                         = "modemmanager_up"
 )
 
+// defaultTimeout is the default timeout for a single scrape of ModemManager.
+const defaultTimeout = 5 * time.Second
+
+// Config configures the metrics collection performed by a handler. A nil
+// Config or any zero value fields will be replaced with sane defaults.
+type Config struct {
+	// Timeout specifies the maximum amount of time allowed for a single scrape
+	// of ModemManager and all of its modems. If zero, a default of 5 seconds
+	// is used.
+	Timeout time.Duration
+
+	// ModemTimeouts optionally overrides Timeout for individual modems, keyed
+	// by each modem's device_id label value, for modems which are slower or
+	// faster to respond than others. A scrape is allowed to run for the
+	// longest of all of the timeouts, but each modem is bounded by its own
+	// timeout or Timeout if it has none.
+	ModemTimeouts map[string]time.Duration
+
+	// DropInfoLabels specifies labels which should be omitted from the
+	// modemmanager_modem_info metric to reduce its cardinality. The device_id
+	// label is always exported, and unknown labels are ignored.
+	DropInfoLabels []string
+
+	// IncludeModems and ExcludeModems optionally filter the modems which are
+	// exported by matching against each modem's device_id label value. If
+	// IncludeModems is set, only matching modems are exported. Modems which
+	// match ExcludeModems are never exported.
+	IncludeModems, ExcludeModems *regexp.Regexp
+
+	// UseEquipmentID specifies that each modem's equipment identifier, such
+	// as its IMEI, is used as the device_id label value instead of its device
+	// identifier. This is useful for modems whose device identifier changes
+	// across reboots.
+	UseEquipmentID bool
+
+	// Labels optionally specifies constant labels and their values which are
+	// added to every metric exported by the handler, such as a label which
+	// identifies the site of a modem when metrics are federated. The labels
+	// must not conflict with any of the labels of the exported metrics.
+	// Metrics from the registry passed to NewHandler are not modified.
+	Labels map[string]string
+
+	// SignalRate optionally specifies how frequently ModemManager should poll
+	// each modem for its extended signal strength data. If set, the rate is
+	// configured for each newly discovered modem during a scrape, including
+	// modems which are hotplugged after the handler is created. ModemManager
+	// only supports whole seconds, so the rate is rounded to the nearest
+	// second.
+	SignalRate time.Duration
+
+	// SignalWindow optionally specifies the number of most recent scrapes over
+	// which the minimum, maximum, and average LTE RSRP of each modem are
+	// tracked, to smooth out transient changes in signal strength. If zero,
+	// these metrics are not exported.
+	SignalWindow int
+
+	// RawSignal specifies that extended signal strength metrics are exported
+	// even when a modem is not registered with a network or reports no signal
+	// data. By default, these readings are omitted because they are
+	// typically meaningless zero values.
+	RawSignal bool
+
+	// DisableCollectors specifies groups of metrics which should not be
+	// gathered or exported, for modems which do not support the ModemManager
+	// interfaces used by a group. Valid collectors are "bearers",
+	// "network_time", "ports", "power_state", and "signal". Unknown collectors
+	// are ignored.
+	DisableCollectors []string
+
+	// Concurrency specifies the maximum number of modems which are scraped
+	// concurrently. If zero, modems are scraped one at a time.
+	Concurrency int
+
+	// CallTimeout optionally specifies the maximum amount of time allowed for
+	// each individual call to a modem within a scrape, so that a single slow
+	// call fails without consuming the entire scrape timeout. If zero, calls
+	// are only bounded by Timeout.
+	CallTimeout time.Duration
+
+	// CacheInterval optionally specifies how long the metrics gathered by a
+	// scrape are cached and served to subsequent scrapes, so that multiple
+	// Prometheus servers do not each query the modems. If zero, every scrape
+	// queries the modems.
+	CacheInterval time.Duration
+
+	// StaleGracePeriod optionally specifies how long the last data gathered
+	// successfully from a modem is exported after gathering data from it
+	// fails, to avoid gaps in the modem's metrics. If set, the metrics derived
+	// from a modem's data carry a "stale" label which is "true" for these
+	// values and "false" otherwise. If zero, the metrics are omitted on
+	// failure.
+	StaleGracePeriod time.Duration
+
+	// Retries specifies the number of times a call to a modem is retried when
+	// it fails due to a transient D-Bus error. If zero, calls are not retried.
+	Retries int
+
+	// Logger optionally specifies a logger for errors which occur while
+	// gathering metrics. If nil, errors are not logged.
+	Logger *log.Logger
+}
+
 // NewHandler returns an http.Handler that serves Prometheus metrics gathered
-// using a ModemManager client.
-func NewHandler(reg *prometheus.Registry, c *modemmanager.Client) http.Handler {
-	mm := metricslite.NewPrometheus(reg)
+// using a ModemManager client. If cfg is nil, a default configuration is used.
+//
+// Metrics from reg are served alongside the exporter's metrics. Canceling an
+// HTTP request cancels any in-flight calls to ModemManager for that request.
+//
+// If c is nil, such as when ModemManager was not available at startup, the
+// handler dials ModemManager on each scrape and reports it as down until it
+// becomes available.
+func NewHandler(reg *prometheus.Registry, c *modemmanager.Client, cfg *Config) http.Handler {
+	return NewExporter(c, cfg).Handler(reg)
+}
+
+// An Exporter gathers data from ModemManager and its modems for one or more
+// HTTP handlers, which share the state tracked for each modem and the signal
+// refresh rate configured for it.
+type Exporter struct {
+	c *collector
+}
+
+// NewExporter creates an Exporter which gathers data using a ModemManager
+// client. If cfg is nil, a default configuration is used. As with NewHandler,
+// c may be nil if ModemManager is not yet available.
+func NewExporter(c *modemmanager.Client, cfg *Config) *Exporter {
+	return &Exporter{c: newCollector(c, cfg)}
+}
+
+// Handler returns an http.Handler that serves Prometheus metrics gathered by
+// the Exporter alongside the metrics from reg, as with NewHandler.
+func (e *Exporter) Handler(reg *prometheus.Registry) http.Handler {
+	return newHandler(reg, newPromCollector(e.c))
+}
+
+// newHandler returns an http.Handler which serves metrics from reg and pc.
+func newHandler(reg *prometheus.Registry, pc *promCollector) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Each scrape will use the MM client to fetch data, bound to the
+		// lifetime of the HTTP request.
+		mreg := prometheus.NewRegistry()
+		mreg.MustRegister(pc.withContext(r.Context()))
+
+		// Continue on error so that any metrics gathered before an error
+		// occurs are still served, along with the scrape success metric.
+		promhttp.HandlerFor(prometheus.Gatherers{reg, mreg}, promhttp.HandlerOpts{
+			ErrorHandling: promhttp.ContinueOnError,
+		}).ServeHTTP(w, r)
+	})
+}
+
+// NewHandlerFor is like NewHandler, but the exporter's metrics are registered
+// with reg, such as a registerer wrapped by prometheus.WrapRegistererWithPrefix
+// in an application which embeds the exporter, and all metrics are served from
+// g. The registration fails if the metrics conflict with any registered with
+// reg.
+//
+// Unlike NewHandler, canceling an HTTP request does not cancel in-flight calls
+// to ModemManager, which are only bounded by the configured timeouts.
+func NewHandlerFor(reg prometheus.Registerer, g prometheus.Gatherer, c *modemmanager.Client, cfg *Config) (http.Handler, error) {
+	return newHandlerFor(reg, g, newPromCollector(newCollector(c, cfg)))
+}
+
+// newHandlerFor registers pc with reg and returns an http.Handler which serves
+// metrics from g.
+func newHandlerFor(reg prometheus.Registerer, g prometheus.Gatherer, pc *promCollector) (http.Handler, error) {
+	if err := reg.Register(pc); err != nil {
+		return nil, err
+	}
+
+	return promhttp.HandlerFor(g, promhttp.HandlerOpts{
+		ErrorHandling: promhttp.ContinueOnError,
+	}), nil
+}
+
+// A registerer registers const metrics, typically metricslite.Interface.
+type registerer interface {
+	ConstCounter(name, help string, labelNames ...string)
+	ConstGauge(name, help string, labelNames ...string)
+}
+
+// Names of the optional collectors which gather groups of metrics.
+const (
+	collectorBearers     = "bearers"
+	collectorNetworkTime = "network_time"
+	collectorPorts       = "ports"
+	collectorPowerState  = "power_state"
+	collectorSignal      = "signal"
+)
+
+// collectorMetrics maps each optional collector to the metrics it exports.
+var collectorMetrics = map[string][]string{
+	collectorBearers: {
+		mmModemBearerAddressInfo,
+		mmModemBearerConnected,
+		mmModemBearerDuration,
+		mmModemBearerDNSInfo,
+		mmModemBearerInfo,
+		mmModemBearerMTU,
+		mmModemBearerRXBytes,
+		mmModemBearerTXBytes,
+		mmModemBearersTotal,
+	},
+	collectorNetworkTime: {
+		mmModemNetworkTimeSkew,
+		mmModemNetworkTimestamp,
+	},
+	collectorPorts: {
+		mmModemNetworkPortInfo,
+		mmModemPortInfo,
+		mmModemPrimaryPortInfo,
+	},
+	collectorPowerState: {
+		mmModemPowerState,
+		mmModemPowerStateTransitions,
+	},
+	collectorSignal: {
+		mmModemSignalLTERSRQ,
+		mmModemSignalLTERSRQRatio,
+		mmModemSignalLTERSRP,
+		mmModemSignalLTERSRPAvg,
+		mmModemSignalLTERSRPMax,
+		mmModemSignalLTERSRPMin,
+		mmModemSignalLTERSRPRatio,
+		mmModemSignalLTERSSI,
+		mmModemSignalLTESNR,
+		mmModemSignalLost,
+		mmModemSignalPollingActive,
+		mmModemSignalSetupOK,
+		mmModemSignalSetupRate,
+	},
+}
+
+// signalDataMetrics are the per-modem metrics which are derived from a modem's
+// extended signal strength measurements.
+var signalDataMetrics = func() map[string]bool {
+	m := map[string]bool{
+		mmModemSignalLTERSRPAvg:   true,
+		mmModemSignalLTERSRPMax:   true,
+		mmModemSignalLTERSRPMin:   true,
+		mmModemSignalLTERSRPRatio: true,
+		mmModemSignalLTERSRQRatio: true,
+	}
+	for _, sm := range signalMetrics {
+		m[sm.name] = true
+	}
+
+	return m
+}()
+
+// dataMetrics are the per-modem metrics which are derived from data gathered by
+// calls to a modem rather than from the modem's properties, and which are
+// omitted when those calls fail.
+var dataMetrics = func() map[string]bool {
+	m := make(map[string]bool)
+	for _, name := range []string{collectorBearers, collectorNetworkTime, collectorSignal} {
+		for _, metric := range collectorMetrics[name] {
+			m[metric] = true
+		}
+	}
+
+	// The signal refresh rate is configured independently of gathering data,
+	// and signal losses are counted across scrapes.
+	delete(m, mmModemSignalLost)
+	delete(m, mmModemSignalSetupOK)
+	delete(m, mmModemSignalSetupRate)
+
+	return m
+}()
+
+// A filterRegisterer wraps a registerer and skips registration of any metrics
+// which belong to disabled collectors.
+type filterRegisterer struct {
+	registerer
+	skip map[string]bool
+}
+
+func (r filterRegisterer) ConstCounter(name, help string, labelNames ...string) {
+	if !r.skip[name] {
+		r.registerer.ConstCounter(name, help, labelNames...)
+	}
+}
+
+func (r filterRegisterer) ConstGauge(name, help string, labelNames ...string) {
+	if !r.skip[name] {
+		r.registerer.ConstGauge(name, help, labelNames...)
+	}
+}
+
+// A staleRegisterer wraps a registerer and adds a stale label to each of the
+// metrics derived from data gathered from a modem.
+type staleRegisterer struct {
+	registerer
+}
+
+func (r staleRegisterer) ConstCounter(name, help string, labelNames ...string) {
+	r.registerer.ConstCounter(name, help, r.labels(name, labelNames)...)
+}
+
+func (r staleRegisterer) ConstGauge(name, help string, labelNames ...string) {
+	r.registerer.ConstGauge(name, help, r.labels(name, labelNames)...)
+}
 
-	// Each scrape will use the MM client to fetch data.
-	register(mm)
-	mm.OnConstScrape(onScrape(c))
+func (staleRegisterer) labels(name string, labelNames []string) []string {
+	if !dataMetrics[name] {
+		return labelNames
+	}
 
-	return promhttp.HandlerFor(reg, promhttp.HandlerOpts{})
+	return append(labelNames[:len(labelNames):len(labelNames)], "stale")
 }
 
-// register registers the exporter's metrics with the input metrics interface.
-func register(mm metricslite.Interface) {
+// register registers the exporter's metrics with the input registerer.
+// Metrics belonging to disabled collectors are not registered.
+func (c *collector) register(mm registerer) {
+	skip := make(map[string]bool)
+	for name := range c.disabled {
+		for _, m := range collectorMetrics[name] {
+			skip[m] = true
+		}
+	}
+	mm = filterRegisterer{registerer: mm, skip: skip}
+	if c.staleGrace > 0 {
+		mm = staleRegisterer{registerer: mm}
+	}
+
 	mm.ConstGauge(
 		mmInfo,
 		"Metadata about the ModemManager daemon.",
 		"version",
 	)
 
+	mm.ConstGauge(
+		mmModemBearerAddressInfo,
+		"Metadata about the IP addresses assigned to a modem's bearer, with one series for each address family.",
+		"device_id", "bearer", "family", "address",
+	)
+
+	mm.ConstGauge(
+		mmModemBearerConnected,
+		"Indicates whether a modem's bearer is connected (1) or disconnected (0).",
+		"device_id", "bearer",
+	)
+
+	mm.ConstCounter(
+		mmModemBearerDuration,
+		"The number of seconds a modem's bearer has been connected during its current or last connection.",
+		"device_id", "bearer",
+	)
+
+	mm.ConstGauge(
+		mmModemBearerDNSInfo,
+		"Metadata about the DNS servers assigned to a modem's bearer.",
+		"device_id", "bearer", "dns",
+	)
+
+	mm.ConstGauge(
+		mmModemBearerInfo,
+		"Metadata about a modem's bearer. Note that interface refers to the network interface name used by the bearer's data connection.",
+		"device_id", "bearer", "interface",
+	)
+
+	mm.ConstGauge(
+		mmModemBearerMTU,
+		"The MTU in bytes negotiated for a modem's connected bearer.",
+		"device_id", "bearer",
+	)
+
+	mm.ConstCounter(
+		mmModemBearerRXBytes,
+		"The number of bytes received by a modem's bearer during its current or last connection.",
+		"device_id", "bearer",
+	)
+
+	mm.ConstCounter(
+		mmModemBearerTXBytes,
+		"The number of bytes transmitted by a modem's bearer during its current or last connection.",
+		"device_id", "bearer",
+	)
+
+	mm.ConstGauge(
+		mmModemBearersTotal,
+		"The number of bearers currently configured on a modem.",
+		"device_id",
+	)
+
+	mm.ConstGauge(
+		mmModemConnected,
+		"Indicates whether a modem's data connection is established (1) or not (0).",
+		"device_id",
+	)
+
+	mm.ConstGauge(
+		mmModemEnabled,
+		"Indicates whether a modem is enabled (1) or not (0), including any states in which the modem is searching for or connected to a network.",
+		"device_id",
+	)
+
 	mm.ConstGauge(
 		mmModemInfo,
 		"Metadata about a managed modem.",
-		"device_id", "firmware", "imei", "model",
+		c.infoLabels...,
+	)
+
+	mm.ConstGauge(
+		mmModemLastScrape,
+		"The UNIX timestamp when data was last gathered successfully from a modem.",
+		"device_id",
 	)
 
 	mm.ConstGauge(
@@ -64,12 +490,48 @@ func register(mm metricslite.Interface) {
 		"device_id",
 	)
 
+	mm.ConstGauge(
+		mmModemNetworkTimeSkew,
+		"The difference in seconds between the time reported by a modem's cellular network and the exporter's clock, where a large skew may indicate stale network time.",
+		"device_id",
+	)
+
+	mm.ConstGauge(
+		mmModemPortInfo,
+		"Metadata about all of the ports for a modem, including AT, QMI, MBIM, and network ports.",
+		"device_id", "port", "type",
+	)
+
 	mm.ConstGauge(
 		mmModemPowerState,
 		"An enumeration of power states for a modem, where a value of 1 indicates the current state.",
 		"device_id", "state",
 	)
 
+	mm.ConstCounter(
+		mmModemPowerStateTransitions,
+		"The number of times the exporter observed a modem's power state change, labeled by the new power state.",
+		"device_id", "to_state",
+	)
+
+	mm.ConstGauge(
+		mmModemPrimaryPortInfo,
+		"Metadata about the primary control port for a modem, such as the port used for AT or QMI commands.",
+		"device_id", "port",
+	)
+
+	mm.ConstGauge(
+		mmModemScrapeError,
+		"Indicates whether an error occurred (1) or not (0) while gathering data from a modem during a scrape.",
+		"device_id",
+	)
+
+	mm.ConstCounter(
+		mmModemScrapes,
+		"The total number of times data was gathered from a modem, partitioned by whether the scrape succeeded or failed.",
+		"device_id", "result",
+	)
+
 	mm.ConstGauge(
 		mmModemState,
 		"An enumeration of cellular connection states for a modem, where a value of 1 indicates the current state.",
@@ -77,216 +539,1442 @@ func register(mm metricslite.Interface) {
 	)
 
 	mm.ConstGauge(
-		mmModemSignalLTERSRQ,
-		"A modem's current LTE signal RSRQ (Reference Signal Received Quality) in dB.",
+		mmModemStateChanged,
+		"The UNIX timestamp when the exporter observed a change in a modem's cellular connection state, or when the modem was first observed.",
 		"device_id",
 	)
 
+	for _, sm := range signalMetrics {
+		mm.ConstGauge(sm.name, sm.help(), "device_id")
+	}
+
 	mm.ConstGauge(
-		mmModemSignalLTERSRP,
-		"A modem's current LTE signal RSRP (Reference Signal Received Power) in dBm.",
+		mmModemSignalLTERSRQRatio,
+		"A modem's current LTE signal RSRQ normalized to a ratio from 0 to 1 over the 3GPP reporting range of -19.5 to -3 dB.",
 		"device_id",
 	)
 
 	mm.ConstGauge(
-		mmModemSignalLTERSSI,
-		"A modem's current LTE signal RSSI (Received Signal Strength Indication) in dBm.",
+		mmModemSignalLTERSRPAvg,
+		"The average of a modem's LTE signal RSRP in dBm over the most recent scrapes in the configured signal window.",
 		"device_id",
 	)
 
 	mm.ConstGauge(
-		mmModemSignalLTESNR,
-		"A modem's current LTE signal SNR (Signal-to-Noise Ratio) in dB.",
+		mmModemSignalLTERSRPMax,
+		"The maximum of a modem's LTE signal RSRP in dBm over the most recent scrapes in the configured signal window.",
+		"device_id",
+	)
+
+	mm.ConstGauge(
+		mmModemSignalLTERSRPMin,
+		"The minimum of a modem's LTE signal RSRP in dBm over the most recent scrapes in the configured signal window.",
+		"device_id",
+	)
+
+	mm.ConstGauge(
+		mmModemSignalLTERSRPRatio,
+		"A modem's current LTE signal RSRP normalized to a ratio from 0 to 1 over the 3GPP reporting range of -140 to -44 dBm.",
+		"device_id",
+	)
+
+	mm.ConstCounter(
+		mmModemSignalLost,
+		"The number of times the exporter observed a modem lose its signal between scrapes, such as when it is no longer registered with a network or reports no signal data.",
+		"device_id",
+	)
+
+	mm.ConstGauge(
+		mmModemSignalPollingActive,
+		"Indicates whether a modem reports the extended signal strength refresh rate requested by the exporter (1) or not (0), such as when a modem ignores the requested rate.",
+		"device_id",
+	)
+
+	mm.ConstGauge(
+		mmModemSignalSetupOK,
+		"Indicates whether the extended signal strength refresh rate was successfully configured for a modem (1) or not (0).",
+		"device_id",
+	)
+
+	mm.ConstGauge(
+		mmModemSignalSetupRate,
+		"The extended signal strength refresh rate in seconds requested for a modem.",
 		"device_id",
 	)
+
+	mm.ConstGauge(
+		mmModemsTotal,
+		"The number of modems currently managed by ModemManager, including any modems which are not exported.",
+	)
+
+	mm.ConstGauge(
+		mmScrapeDuration,
+		"The amount of time in seconds taken to gather metrics from ModemManager.",
+	)
+
+	mm.ConstGauge(
+		mmScrapeSuccess,
+		"Indicates whether metrics were successfully gathered from ModemManager (1) or not (0).",
+	)
+
+	mm.ConstGauge(
+		mmSignalRefreshRate,
+		"The extended signal strength refresh rate in seconds configured by the exporter for each modem, or 0 if the exporter does not configure the refresh rate.",
+	)
+
+	mm.ConstGauge(
+		mmStartTimestamp,
+		"The UNIX timestamp when the exporter connected to ModemManager, which approximates when ModemManager started if it restarts while the exporter is running.",
+	)
+
+	mm.ConstGauge(
+		mmUp,
+		"Indicates whether ModemManager responded on D-Bus (1) or not (0), regardless of the number of modems present.",
+	)
+
+	mm.ConstCounter(
+		mmScrapeErrors,
+		"The total number of errors which occurred while gathering metrics from ModemManager or its modems.",
+	)
 }
 
-// onScrape returns a metricslite.ScrapeFunc which uses a MM client to gather
-// metrics.
-func onScrape(c *modemmanager.Client) metricslite.ScrapeFunc {
-	return func(metrics map[string]func(value float64, labels ...string)) error {
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-
-		err := c.ForEachModem(ctx, func(ctx context.Context, m *modemmanager.Modem) error {
-			// Perform any necessary calls before exporting any metrics.
-			now, err := m.GetNetworkTime(ctx)
-			if err != nil {
-				return fmt.Errorf("failed to get network time: %v", err)
-			}
+// A collector gathers metrics from ModemManager.
+type collector struct {
+	timeout          time.Duration
+	modemTimeouts    map[string]time.Duration
+	callTimeout      time.Duration
+	infoLabels       []string
+	include, exclude *regexp.Regexp
+	equipmentID      bool
+	labels           prometheus.Labels
+	rate             time.Duration
+	window           int
+	rawSignal        bool
+	disabled         map[string]bool
+	concurrency      int
+	retries          int
+	retryDelay       time.Duration
+	ll               *log.Logger
 
-			s, err := m.Signal(ctx)
-			if err != nil {
-				return fmt.Errorf("failed to get signal strength: %v", err)
-			}
+	// scrapeErrors counts errors which occur while gathering metrics.
+	scrapeErrors uint64
 
-			scrape(metrics, m, now, s)
-			return nil
-		})
-		if err != nil {
-			return &metricslite.ScrapeError{
-				Metric: mmInfo,
-				Err:    err,
-			}
-		}
+	// cacheMu guards cache, which holds the result of the last successful
+	// scrape when cacheInterval is set, and last, which holds the result of
+	// the last refresh of the cache whether or not it succeeded. refreshes
+	// counts the refreshes so that scrapes which waited on a refresh can
+	// share its result.
+	cacheMu       sync.Mutex
+	cacheInterval time.Duration
+	cache, last   *cachedScrape
+	refreshes     uint64
 
-		// Export MM metadata outside the loop so it'll be present even if no
-		// modems are detected.
-		metrics[mmInfo](1.0, c.Version)
+	// staleGrace is how long the last good data for a modem is exported
+	// after a failure.
+	staleGrace time.Duration
 
-		return nil
-	}
+	// callDuration observes the duration of each call to a modem. It is a
+	// native Prometheus histogram because metricslite does not support
+	// histograms.
+	callDuration *prometheus.HistogramVec
+
+	// configured tracks the modem index for each modem ID which has had its
+	// signal rate configured, and modems tracks the state of each modem ID
+	// across scrapes.
+	mu         sync.Mutex
+	configured map[string]int
+	modems     map[string]*modemState
+
+	// now returns the current time and is swappable for tests.
+	now func() time.Time
+
+	// Functions which normally query ModemManager but are also swappable for
+	// tests.
+	version      func() string
+	started      func() time.Time
+	forEachModem func(ctx context.Context, fn func(ctx context.Context, m *modemmanager.Modem) error) error
+	networkTime  func(m *modemmanager.Modem, ctx context.Context) (time.Time, error)
+	signal       func(m *modemmanager.Modem, ctx context.Context) (*modemmanager.Signal, error)
+	signalSetup  func(m *modemmanager.Modem, ctx context.Context, rate time.Duration) error
+	bearers      func(m *modemmanager.Modem, ctx context.Context) ([]*modemmanager.Bearer, error)
 }
 
-// scrape performs a single metrics collection pass for one modem and its data.
-func scrape(metrics map[string]func(value float64, labels ...string), m *modemmanager.Modem, now time.Time, s *modemmanager.Signal) {
-	// Device ID is used as the unique key on metrics.
-	id := m.DeviceIdentifier
+// newCollector creates a collector which uses a MM client to gather metrics.
+func newCollector(c *modemmanager.Client, cfg *Config) *collector {
+	if cfg == nil {
+		cfg = &Config{}
+	}
 
-	for name, c := range metrics {
-		switch name {
-		case mmInfo:
-			// Skip, handled outside this loop.
-		case mmModemInfo:
-			c(1.0, id, m.Revision, m.EquipmentIdentifier, m.Model)
-		case mmModemNetworkPortInfo:
-			portInfo(c, m)
-		case mmModemNetworkTimestamp:
-			c(float64(now.Unix()), id)
-		case mmModemPowerState:
-			powerState(c, m)
-		case mmModemState:
-			state(c, m)
-		case mmModemSignalLTERSRP:
-			c(s.LTE.RSRP, id)
-		case mmModemSignalLTERSRQ:
-			c(s.LTE.RSRQ, id)
-		case mmModemSignalLTERSSI:
-			c(s.LTE.RSSI, id)
-		case mmModemSignalLTESNR:
-			c(s.LTE.SNR, id)
-		default:
-			panicf("modemmanager_exporter: unhandled metric %q", name)
-		}
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+
+	ll := cfg.Logger
+	if ll == nil {
+		ll = log.New(io.Discard, "", 0)
+	}
+
+	concurrency := cfg.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	disabled := make(map[string]bool)
+	for _, name := range cfg.DisableCollectors {
+		disabled[name] = true
+	}
+
+	// Wrap the client so ModemManager is redialed if it restarts.
+	mmc := newClient(c)
+
+	return &collector{
+		timeout:       timeout,
+		modemTimeouts: cfg.ModemTimeouts,
+		cacheInterval: cfg.CacheInterval,
+		staleGrace:    cfg.StaleGracePeriod,
+		callTimeout:   cfg.CallTimeout,
+		infoLabels:    infoLabels(cfg.DropInfoLabels),
+		include:       cfg.IncludeModems,
+		exclude:       cfg.ExcludeModems,
+		equipmentID:   cfg.UseEquipmentID,
+		labels:        cfg.Labels,
+		rate:          cfg.SignalRate.Round(time.Second),
+		window:        cfg.SignalWindow,
+		rawSignal:     cfg.RawSignal,
+		disabled:      disabled,
+		concurrency:   concurrency,
+		retries:       cfg.Retries,
+		retryDelay:    100 * time.Millisecond,
+		callDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:        mmDBusCallDuration,
+			Help:        "The amount of time in seconds taken by each D-Bus call to a modem, labeled by method.",
+			ConstLabels: cfg.Labels,
+		}, []string{"method"}),
+		ll:           ll,
+		configured:   make(map[string]int),
+		modems:       make(map[string]*modemState),
+		now:          time.Now,
+		version:      mmc.Version,
+		started:      mmc.Connected,
+		forEachModem: mmc.ForEachModem,
+		networkTime:  (*modemmanager.Modem).GetNetworkTime,
+		signal:       (*modemmanager.Modem).Signal,
+		signalSetup:  (*modemmanager.Modem).SignalSetup,
+		bearers:      (*modemmanager.Modem).Bearers,
 	}
 }
 
-// portInfo collects a Modem's network port info metrics.
-func portInfo(c func(value float64, labels ...string), m *modemmanager.Modem) {
-	for _, p := range m.Ports {
-		// Only export information about network ports because they can be
-		// joined with other metrics such as those from node_exporter. It isn't
-		// clear that exporting AT, MBIM, etc. would be useful at this point.
-		if p.Type != modemmanager.PortTypeNet {
-			continue
-		}
+// onScrape implements metricslite.ScrapeFunc by gathering metrics from
+// ModemManager and its modems.
+func (c *collector) onScrape(metrics map[string]func(value float64, labels ...string)) error {
+	return c.onScrapeContext(context.Background(), metrics)
+}
 
-		c(1.0, m.DeviceIdentifier, p.Name)
+// onScrapeContext is like onScrape, but the scrape is canceled when ctx is
+// canceled. If c.cacheInterval is set, metrics are served from the cache
+// until it expires, and the cache is refreshed independently of ctx.
+func (c *collector) onScrapeContext(ctx context.Context, metrics map[string]func(value float64, labels ...string)) error {
+	if c.cacheInterval == 0 {
+		return c.gather(ctx, metrics, nil)
 	}
+
+	cs := c.cached()
+	replay(metrics, cs.samples)
+	return cs.err
 }
 
-// powerState collects a Modem's power state metrics as an enum.
-func powerState(c func(value float64, labels ...string), m *modemmanager.Modem) {
-	states := []struct {
-		s  string
-		ps modemmanager.PowerState
-	}{
-		{
-			s:  "unknown",
-			ps: modemmanager.PowerStateUnknown,
-		},
-		{
-			s:  "off",
-			ps: modemmanager.PowerStateOff,
-		},
-		{
-			s:  "low",
-			ps: modemmanager.PowerStateLow,
-		},
-		{
-			s:  "on",
-			ps: modemmanager.PowerStateOn,
-		},
+// cached returns the cached result of a scrape, refreshing the cache if it has
+// expired or the last refresh failed.
+func (c *collector) cached() *cachedScrape {
+	// Hold the lock while gathering so that concurrent scrapes share a single
+	// pass over the modems.
+	n := atomic.LoadUint64(&c.refreshes)
+	c.cacheMu.Lock()
+	defer c.cacheMu.Unlock()
+
+	if atomic.LoadUint64(&c.refreshes) != n {
+		// The cache was refreshed while this scrape waited for the lock, so
+		// share the result even if the refresh failed. Otherwise each waiting
+		// scrape would gather again in turn while ModemManager is failing.
+		return c.last
 	}
 
-	// Export all power states but note the active one with a value of 1.0.
-	for _, s := range states {
-		var f float64
-		if s.ps == m.PowerState {
-			f = 1.0
+	if c.cache == nil || c.now().Sub(c.cache.time) >= c.cacheInterval {
+		// Record samples for every metric registered by the collector, as the
+		// result may be served to any of the exporter's handlers.
+		names := make(metricNames)
+		c.register(names)
+
+		var samples []sample
+		record := make(map[string]func(value float64, labels ...string), len(names))
+		for name := range names {
+			// Shadow name for each closure.
+			name := name
+			record[name] = func(value float64, labels ...string) {
+				samples = append(samples, sample{
+					name:   name,
+					value:  value,
+					labels: append([]string(nil), labels...),
+				})
+			}
+		}
+
+		// The refresh is shared by every scrape waiting on the cache, so it
+		// must not be canceled by any one of them. gather still bounds it
+		// with the scrape timeout.
+		modems := make([]jsonModem, 0)
+		err := c.gather(context.Background(), record, func(d *modemData) {
+			modems = append(modems, c.jsonModem(d))
+		})
+		c.last = &cachedScrape{
+			time:    c.now(),
+			samples: samples,
+			modems:  modems,
+			err:     err,
 		}
+		atomic.AddUint64(&c.refreshes, 1)
 
-		c(f, m.DeviceIdentifier, s.s)
+		if err != nil {
+			// Don't cache a failed scrape so the next scrape tries again.
+			return c.last
+		}
+
+		c.cache = c.last
 	}
+
+	return c.cache
 }
 
-// state collects a Modem's state metrics as an enum.
-func state(c func(value float64, labels ...string), m *modemmanager.Modem) {
-	states := []struct {
-		s  string
-		st modemmanager.State
-	}{
-		{
-			s:  "failed",
-			st: modemmanager.StateFailed,
-		},
-		{
-			s:  "unknown",
-			st: modemmanager.StateUnknown,
-		},
-		{
-			s:  "locked",
-			st: modemmanager.StateLocked,
-		},
-		{
-			s:  "disabled",
-			st: modemmanager.StateDisabled,
-		},
-		{
-			s:  "disabling",
-			st: modemmanager.StateDisabling,
-		},
-		{
-			s:  "enabling",
-			st: modemmanager.StateEnabling,
-		},
-		{
-			s:  "enabled",
-			st: modemmanager.StateEnabled,
-		},
-		{
-			s:  "searching",
-			st: modemmanager.StateSearching,
-		},
-		{
-			s:  "registered",
-			st: modemmanager.StateRegistered,
-		},
-		{
-			s:  "disconnecting",
-			st: modemmanager.StateDisconnecting,
-		},
-		{
-			s:  "connecting",
-			st: modemmanager.StateConnecting,
-		},
-		{
-			s:  "connected",
-			st: modemmanager.StateConnected,
-		},
-	}
+// A cachedScrape is the result of a scrape, including the metrics samples and
+// the JSON representation of each modem. The result of a successful scrape is
+// served until the cache interval expires.
+type cachedScrape struct {
+	time    time.Time
+	samples []sample
+	modems  []jsonModem
+	err     error
+}
 
-	// Export all power states but note the active one with a value of 1.0.
-	for _, s := range states {
-		var f float64
-		if s.st == m.State {
-			f = 1.0
-		}
+// A metricNames is a registerer which records the names of the registered
+// metrics.
+type metricNames map[string]bool
+
+func (n metricNames) ConstCounter(name, _ string, _ ...string) { n[name] = true }
+func (n metricNames) ConstGauge(name, _ string, _ ...string)   { n[name] = true }
+
+// A sample is a single metric observation recorded for the cache.
+type sample struct {
+	name   string
+	value  float64
+	labels []string
+}
 
-		c(f, m.DeviceIdentifier, s.s)
+// replay invokes the metrics functions for each of the input samples.
+func replay(metrics map[string]func(value float64, labels ...string), samples []sample) {
+	for _, s := range samples {
+		metrics[s.name](s.value, s.labels...)
 	}
 }
 
+// gather gathers metrics from up to c.concurrency modems at a time, allowing
+// up to c.scrapeTimeout for each scrape. If fn is not nil, it is also called
+// with the data gathered from each modem.
+func (c *collector) gather(ctx context.Context, metrics map[string]func(value float64, labels ...string), fn func(d *modemData)) error {
+	ctx, cancel := context.WithTimeout(ctx, c.scrapeTimeout())
+	defer cancel()
+
+	start, now := time.Now(), c.now()
+	n, err := c.forEachModemData(ctx, func(d *modemData) {
+		// Only scrapes track the state of each modem across scrapes, so that
+		// other uses of the modem data do not affect it.
+		c.observeData(d)
+
+		// Errors which occur while gathering data from a single modem are
+		// reported as metrics rather than failing the entire scrape, so that
+		// metrics for any healthy modems are still exported.
+		ms := c.scraped(d.state, d.err == nil)
+		d.lastScrape, d.successes, d.failures = ms.scraped, ms.successes, ms.failures
+		for _, err := range []error{d.setupErr, d.err} {
+			if err != nil {
+				c.ll.Printf("modem %q: %v", c.modemID(d.m), err)
+				atomic.AddUint64(&c.scrapeErrors, 1)
+			}
+		}
+
+		c.scrape(metrics, d)
+		if fn != nil {
+			fn(d)
+		}
+	})
+	if err != nil {
+		c.ll.Printf("failed to scrape ModemManager: %v", err)
+		atomic.AddUint64(&c.scrapeErrors, 1)
+	} else {
+		// Only a complete pass over the modems reveals which are gone.
+		c.prune(now)
+	}
+
+	// Always report on the scrape itself, regardless of the outcome.
+	metrics[mmScrapeDuration](time.Since(start).Seconds())
+	metrics[mmScrapeSuccess](boolFloat(err == nil))
+	// Errors such as timeouts or a single misbehaving modem fail the scrape,
+	// but ModemManager is only down when it cannot be reached at all.
+	metrics[mmUp](boolFloat(!isUnreachable(err)))
+	metrics[mmScrapeErrors](float64(atomic.LoadUint64(&c.scrapeErrors)))
+	metrics[mmSignalRefreshRate](c.rate.Seconds())
+
+	if err != nil {
+		return &metricslite.ScrapeError{
+			Metric: mmInfo,
+			Err:    err,
+		}
+	}
+
+	// Export MM metadata outside the loop so it'll be present even if no
+	// modems are detected.
+	metrics[mmInfo](1.0, c.version())
+	metrics[mmStartTimestamp](float64(c.started().Unix()))
+	metrics[mmModemsTotal](float64(n))
+
+	return nil
+}
+
+// forEachModemData gathers data from each exported modem, scraping up to
+// c.concurrency modems at a time, and calls fn serially with the data for each
+// modem. It returns the number of modems visited, including any which are not
+// exported.
+func (c *collector) forEachModemData(ctx context.Context, fn func(d *modemData)) (int, error) {
+	var (
+		n int
+
+		// sem bounds the number of modems scraped concurrently, and mu
+		// serializes calls to fn.
+		sem = make(chan struct{}, c.concurrency)
+		wg  sync.WaitGroup
+		mu  sync.Mutex
+	)
+
+	err := c.forEachModem(ctx, func(ctx context.Context, m *modemmanager.Modem) error {
+		n++
+		if !c.filter(c.modemID(m)) {
+			// Modem is not exported, skip it.
+			return nil
+		}
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			ctx, cancel := context.WithTimeout(ctx, c.modemTimeout(m))
+			defer cancel()
+
+			d := c.collect(ctx, m)
+
+			mu.Lock()
+			defer mu.Unlock()
+			fn(d)
+		}()
+
+		return nil
+	})
+
+	// Wait for all in-flight modems before returning.
+	wg.Wait()
+	return n, err
+}
+
+// scrapeTimeout returns the maximum amount of time allowed for a scrape of all
+// modems, which is the longest of c.timeout and any per-modem timeout.
+func (c *collector) scrapeTimeout() time.Duration {
+	timeout := c.timeout
+	for _, t := range c.modemTimeouts {
+		if t > timeout {
+			timeout = t
+		}
+	}
+
+	return timeout
+}
+
+// modemTimeout returns the maximum amount of time allowed to gather data from
+// m, falling back to c.timeout if m has no timeout of its own.
+func (c *collector) modemTimeout(m *modemmanager.Modem) time.Duration {
+	if t, ok := c.modemTimeouts[c.modemID(m)]; ok && t > 0 {
+		return t
+	}
+
+	return c.timeout
+}
+
+// filter reports whether a modem with the input modem ID should be exported.
+func (c *collector) filter(id string) bool {
+	if c.include != nil && !c.include.MatchString(id) {
+		return false
+	}
+
+	return c.exclude == nil || !c.exclude.MatchString(id)
+}
+
+// modemID returns the identifier used as the device_id label value for m.
+func (c *collector) modemID(m *modemmanager.Modem) string {
+	if c.equipmentID {
+		return m.EquipmentIdentifier
+	}
+
+	return m.DeviceIdentifier
+}
+
+// modemData contains the data gathered from a single modem during a scrape.
+type modemData struct {
+	m   *modemmanager.Modem
+	now time.Time
+	s   *modemmanager.Signal
+	bs  []*modemmanager.Bearer
+
+	// stateChanged is the time when a change in the modem's state was
+	// observed, and lastScrape is the time when data was last gathered
+	// successfully from the modem.
+	stateChanged, lastScrape time.Time
+
+	// rsrp holds the LTE RSRP samples in the modem's signal window, if any.
+	rsrp []float64
+
+	// validSignal reports whether the signal data appears to be valid, and
+	// invalidSignal reports whether the signal data should not be exported.
+	validSignal, invalidSignal bool
+
+	// signalLost counts the observed losses of the modem's signal.
+	signalLost uint64
+
+	// powerTransitions counts the observed changes in the modem's power state
+	// by the new power state.
+	powerTransitions map[modemmanager.PowerState]uint64
+
+	// successes and failures count the scrapes of the modem by result.
+	successes, failures uint64
+
+	// setupErr reports any error which occurred while configuring the signal
+	// refresh rate. The remaining data is still gathered in this case.
+	setupErr error
+
+	// err reports any error which occurred while gathering data.
+	err error
+
+	// state is the state tracked for the modem across scrapes, which is only
+	// set during a scrape. It is kept here rather than looked up again
+	// because the modem may be pruned from c.modems by a concurrent scrape.
+	state *modemState
+}
+
+// observeData records the data gathered from a modem in the state tracked for
+// it across scrapes, and updates d with the tracked state.
+func (c *collector) observeData(d *modemData) {
+	state, ms := c.observe(d.m)
+	d.state = state
+	d.stateChanged, d.powerTransitions = ms.changed, ms.powerTransitions
+
+	if d.s == nil {
+		// No signal data was gathered.
+		return
+	}
+
+	d.signalLost = c.observeSignalLoss(state, d.validSignal)
+	if !d.invalidSignal {
+		d.rsrp = c.observeSignal(state, d.s)
+	}
+}
+
+// collect gathers all of the data necessary to export metrics for a modem.
+func (c *collector) collect(ctx context.Context, m *modemmanager.Modem) *modemData {
+	d := &modemData{m: m}
+
+	if err := c.setup(ctx, m); err != nil {
+		d.setupErr = fmt.Errorf("failed to set signal refresh rate: %v", err)
+	}
+
+	if c.enabled(collectorNetworkTime) {
+		err := c.retry(ctx, "GetNetworkTime", func(ctx context.Context) error {
+			now, err := c.networkTime(m, ctx)
+			d.now = now
+			return err
+		})
+		if err != nil {
+			d.err = fmt.Errorf("failed to get network time: %v", err)
+			return d
+		}
+	}
+
+	if c.enabled(collectorSignal) {
+		err := c.retry(ctx, "Signal", func(ctx context.Context) error {
+			s, err := c.signal(m, ctx)
+			d.s = s
+			return err
+		})
+		if err != nil {
+			d.err = fmt.Errorf("failed to get signal strength: %v", err)
+			return d
+		}
+
+		// Readings from modems which are not registered with a network are
+		// typically zero values, so only keep them if requested.
+		d.validSignal = validSignal(m, d.s)
+		d.invalidSignal = !c.rawSignal && !d.validSignal
+	}
+
+	if c.enabled(collectorBearers) {
+		err := c.retry(ctx, "Bearers", func(ctx context.Context) error {
+			bs, err := c.bearers(m, ctx)
+			d.bs = bs
+			return err
+		})
+		if err != nil {
+			d.err = fmt.Errorf("failed to get bearers: %v", err)
+			return d
+		}
+	}
+
+	return d
+}
+
+// call invokes fn to call the named modem method with a context bounded by
+// c.callTimeout, and observes the duration of the call.
+func (c *collector) call(ctx context.Context, method string, fn func(ctx context.Context) error) error {
+	ctx, cancel := c.callContext(ctx)
+	defer cancel()
+
+	start := time.Now()
+	defer func() {
+		c.callDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	}()
+
+	return fn(ctx)
+}
+
+// callContext returns a context for a single call to a modem which is bounded
+// by c.callTimeout, if set, so that one slow call cannot consume the entire
+// scrape timeout.
+func (c *collector) callContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.callTimeout == 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, c.callTimeout)
+}
+
+// enabled reports whether the named collector is enabled.
+func (c *collector) enabled(name string) bool {
+	return !c.disabled[name]
+}
+
+// retry invokes fn to call the named modem method, retrying up to c.retries
+// times with exponential backoff while fn returns a transient D-Bus error. Each
+// attempt is bounded by c.callTimeout, if set.
+func (c *collector) retry(ctx context.Context, method string, fn func(ctx context.Context) error) error {
+	delay := c.retryDelay
+	for i := 0; ; i++ {
+		err := c.call(ctx, method, fn)
+		if err == nil || i >= c.retries || !isTransient(err) {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+
+		delay *= 2
+	}
+}
+
+// A modemState tracks the state of a modem across scrapes.
+type modemState struct {
+	state   modemmanager.State
+	changed time.Time
+	scraped time.Time
+
+	// seen is the time when the modem was last observed, used to forget
+	// modems which are no longer present.
+	seen time.Time
+
+	successes, failures uint64
+
+	powerState       modemmanager.PowerState
+	powerTransitions map[modemmanager.PowerState]uint64
+
+	// rsrp holds the most recent LTE RSRP samples when a signal window is
+	// configured.
+	rsrp *ring
+
+	// good holds the data metrics samples from the last successful scrape at
+	// time goodTime, when a stale grace period is configured.
+	good     []sample
+	goodTime time.Time
+
+	// signalSeen and signalValid track whether the modem had a valid signal
+	// when it was last scraped, so signalLost can count losses of signal.
+	signalSeen, signalValid bool
+	signalLost              uint64
+}
+
+// observe records the current state and power state of m and returns its
+// state along with a copy of the updated state.
+func (c *collector) observe(m *modemmanager.Modem) (*modemState, modemState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	id := c.modemID(m)
+	ms, ok := c.modems[id]
+	if !ok {
+		ms = &modemState{}
+		c.modems[id] = ms
+	}
+
+	ms.seen = c.now()
+	if !ok || ms.state != m.State {
+		ms.state = m.State
+		ms.changed = ms.seen
+	}
+
+	// The first observation of a modem's power state is not a transition.
+	if !ok {
+		ms.powerState = m.PowerState
+		ms.powerTransitions = make(map[modemmanager.PowerState]uint64)
+	}
+	if ms.powerState != m.PowerState {
+		ms.powerState = m.PowerState
+		ms.powerTransitions[m.PowerState]++
+	}
+
+	// Copy the transitions so they can be read without holding the lock.
+	out := *ms
+	out.powerTransitions = make(map[modemmanager.PowerState]uint64, len(ms.powerTransitions))
+	for k, v := range ms.powerTransitions {
+		out.powerTransitions[k] = v
+	}
+
+	return ms, out
+}
+
+// observeSignal records the LTE RSRP of a modem in its signal window and returns the
+// samples in the window, or nil if no window is configured.
+func (c *collector) observeSignal(ms *modemState, s *modemmanager.Signal) []float64 {
+	if c.window <= 0 || s == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if ms.rsrp == nil {
+		ms.rsrp = newRing(c.window)
+	}
+
+	ms.rsrp.add(s.LTE.RSRP)
+	return ms.rsrp.values()
+}
+
+// storeGood records the data metrics samples from a successful scrape of a
+// modem.
+func (c *collector) storeGood(ms *modemState, samples []sample) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ms.good, ms.goodTime = samples, c.now()
+}
+
+// lastGood returns the data metrics samples from the last successful scrape of
+// a modem if it occurred within the stale grace period.
+func (c *collector) lastGood(ms *modemState) []sample {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.now().Sub(ms.goodTime) >= c.staleGrace {
+		return nil
+	}
+
+	return ms.good
+}
+
+// observeSignalLoss records whether a modem currently has a valid signal and
+// returns the number of times it has been observed to lose its signal.
+func (c *collector) observeSignalLoss(ms *modemState, valid bool) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if ms.signalSeen && ms.signalValid && !valid {
+		ms.signalLost++
+	}
+	ms.signalSeen, ms.signalValid = true, valid
+
+	return ms.signalLost
+}
+
+// prune forgets the state of any modems which have not been observed since
+// the start of the stale grace period before now, so that modems which are
+// removed or reappear under a new identifier do not accumulate state.
+func (c *collector) prune(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cutoff := now.Add(-c.staleGrace)
+	for id, ms := range c.modems {
+		if ms.seen.Before(cutoff) {
+			delete(c.modems, id)
+			delete(c.configured, id)
+		}
+	}
+}
+
+// scraped records the result of a scrape of a modem, including the current
+// time as the last successful scrape if ok is true, and returns the updated
+// state.
+func (c *collector) scraped(ms *modemState, ok bool) modemState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if ok {
+		ms.scraped = c.now()
+		ms.successes++
+	} else {
+		ms.failures++
+	}
+
+	return *ms
+}
+
+// setup configures the signal refresh rate for m if it has not been configured
+// previously.
+func (c *collector) setup(ctx context.Context, m *modemmanager.Modem) error {
+	if c.rate == 0 || !c.enabled(collectorSignal) {
+		// Signal rate configuration disabled.
+		return nil
+	}
+
+	// A modem which is reattached receives a new index from ModemManager and
+	// must be configured again.
+	id := c.modemID(m)
+	c.mu.Lock()
+	idx, ok := c.configured[id]
+	c.mu.Unlock()
+	if ok && idx == m.Index {
+		return nil
+	}
+
+	// Don't hold the lock during the D-Bus call so that other modems scraped
+	// concurrently are not blocked.
+	err := c.call(ctx, "SignalSetup", func(ctx context.Context) error {
+		return c.signalSetup(m, ctx, c.rate)
+	})
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.configured[id] = m.Index
+	return nil
+}
+
+// scrape performs a single metrics collection pass for one modem and its data.
+func (c *collector) scrape(metrics map[string]func(value float64, labels ...string), d *modemData) {
+	var (
+		m   = d.m
+		now = d.now
+		s   = d.s
+		bs  = d.bs
+
+		// Device ID is used as the unique key on metrics.
+		id = c.modemID(m)
+	)
+
+	if c.staleGrace > 0 {
+		var fresh []sample
+		metrics = c.staleMetrics(metrics, d, &fresh)
+		defer func() {
+			if d.err == nil {
+				c.storeGood(d.state, fresh)
+			}
+		}()
+	}
+
+	for name, fn := range metrics {
+		if d.err != nil && dataMetrics[name] {
+			// Data could not be gathered for this modem, so only report the
+			// metrics derived from its properties.
+			continue
+		}
+		if d.invalidSignal && signalDataMetrics[name] {
+			continue
+		}
+
+		switch name {
+		case mmInfo, mmModemsTotal, mmScrapeDuration, mmScrapeErrors, mmScrapeSuccess, mmSignalRefreshRate, mmStartTimestamp, mmUp:
+			// Skip, handled outside this loop.
+		case mmModemScrapeError:
+			fn(boolFloat(d.err != nil), id)
+		case mmModemBearerAddressInfo:
+			for _, b := range bs {
+				for family, ipc := range ipConfigs(b) {
+					if ipc.Address != nil && ipc.Address.IP != nil {
+						fn(1.0, id, bearerID(b), family, ipc.Address.IP.String())
+					}
+				}
+			}
+		case mmModemBearerConnected:
+			for _, b := range bs {
+				fn(boolFloat(b.Connected), id, bearerID(b))
+			}
+		case mmModemBearerDuration:
+			bearerStats(fn, id, bs, func(bs *modemmanager.BearerStats) float64 {
+				return bs.Duration.Seconds()
+			})
+		case mmModemBearerDNSInfo:
+			for _, b := range bs {
+				for _, ipc := range ipConfigs(b) {
+					for _, dns := range ipc.DNS {
+						fn(1.0, id, bearerID(b), dns.String())
+					}
+				}
+			}
+		case mmModemBearerInfo:
+			for _, b := range bs {
+				fn(1.0, id, bearerID(b), b.Interface)
+			}
+		case mmModemBearerMTU:
+			for _, b := range bs {
+				if mtu := bearerMTU(b); b.Connected && mtu > 0 {
+					fn(float64(mtu), id, bearerID(b))
+				}
+			}
+		case mmModemBearerRXBytes:
+			bearerStats(fn, id, bs, func(bs *modemmanager.BearerStats) float64 {
+				return float64(bs.RXBytes)
+			})
+		case mmModemBearerTXBytes:
+			bearerStats(fn, id, bs, func(bs *modemmanager.BearerStats) float64 {
+				return float64(bs.TXBytes)
+			})
+		case mmModemBearersTotal:
+			fn(float64(len(bs)), id)
+		case mmModemConnected:
+			fn(boolFloat(m.State == modemmanager.StateConnected), id)
+		case mmModemEnabled:
+			fn(boolFloat(m.State >= modemmanager.StateEnabled), id)
+		case mmModemInfo:
+			fn(1.0, c.infoValues(m)...)
+		case mmModemLastScrape:
+			if !d.lastScrape.IsZero() {
+				fn(float64(d.lastScrape.Unix()), id)
+			}
+		case mmModemNetworkPortInfo:
+			portInfo(fn, id, m)
+		case mmModemNetworkTimeSkew:
+			fn(now.Sub(c.now()).Seconds(), id)
+		case mmModemNetworkTimestamp:
+			fn(float64(now.Unix()), id)
+		case mmModemPortInfo:
+			for _, p := range m.Ports {
+				fn(1.0, id, p.Name, portType(p.Type))
+			}
+		case mmModemPowerState:
+			powerState(fn, id, m)
+		case mmModemPowerStateTransitions:
+			for _, ps := range powerStates {
+				fn(float64(d.powerTransitions[ps.ps]), id, ps.s)
+			}
+		case mmModemPrimaryPortInfo:
+			if m.PrimaryPort != "" {
+				fn(1.0, id, m.PrimaryPort)
+			}
+		case mmModemScrapes:
+			scrapes(fn, id, d)
+		case mmModemState:
+			state(fn, id, m)
+		case mmModemStateChanged:
+			fn(float64(d.stateChanged.Unix()), id)
+		case mmModemSignalLTERSRPAvg:
+			if len(d.rsrp) > 0 {
+				_, _, avg := summarize(d.rsrp)
+				fn(avg, id)
+			}
+		case mmModemSignalLTERSRPMax:
+			if len(d.rsrp) > 0 {
+				_, max, _ := summarize(d.rsrp)
+				fn(max, id)
+			}
+		case mmModemSignalLTERSRPMin:
+			if len(d.rsrp) > 0 {
+				min, _, _ := summarize(d.rsrp)
+				fn(min, id)
+			}
+		case mmModemSignalLTERSRPRatio:
+			fn(signalRatio(s.LTE.RSRP, lteRSRPMin, lteRSRPMax), id)
+		case mmModemSignalLTERSRQRatio:
+			fn(signalRatio(s.LTE.RSRQ, lteRSRQMin, lteRSRQMax), id)
+		case mmModemSignalLost:
+			fn(float64(d.signalLost), id)
+		case mmModemSignalPollingActive:
+			if c.rate != 0 {
+				fn(boolFloat(s.Rate == c.rate), id)
+			}
+		case mmModemSignalSetupOK:
+			if c.rate != 0 {
+				fn(boolFloat(d.setupErr == nil), id)
+			}
+		case mmModemSignalSetupRate:
+			if c.rate != 0 {
+				fn(c.rate.Seconds(), id)
+			}
+		default:
+			sm, ok := lookupSignalMetric(name)
+			if !ok {
+				panicf("modemmanager_exporter: unhandled metric %q", name)
+			}
+
+			fn(sm.value(s), id)
+		}
+	}
+}
+
+// modemInfoLabels are the label names for the modem info metric. New labels
+// are appended to preserve the order of existing labels.
+var modemInfoLabels = []string{"device_id", "firmware", "imei", "model", "manufacturer", "hardware_revision", "index"}
+
+// infoLabels returns the modem info metric label names, omitting any labels
+// in drop except for device_id.
+func infoLabels(drop []string) []string {
+	skip := make(map[string]bool, len(drop))
+	for _, d := range drop {
+		skip[d] = true
+	}
+
+	labels := make([]string, 0, len(modemInfoLabels))
+	for _, l := range modemInfoLabels {
+		if l != "device_id" && skip[l] {
+			continue
+		}
+
+		labels = append(labels, l)
+	}
+
+	return labels
+}
+
+// infoValues returns the modem info metric label values for m which
+// correspond to c.infoLabels.
+func (c *collector) infoValues(m *modemmanager.Modem) []string {
+	values := map[string]string{
+		"device_id":         c.modemID(m),
+		"firmware":          m.Revision,
+		"imei":              m.EquipmentIdentifier,
+		"model":             m.Model,
+		"manufacturer":      m.Manufacturer,
+		"hardware_revision": m.HardwareRevision,
+		"index":             strconv.Itoa(m.Index),
+	}
+
+	out := make([]string, 0, len(c.infoLabels))
+	for _, l := range c.infoLabels {
+		out = append(out, values[l])
+	}
+
+	return out
+}
+
+// bearerID returns the label value used to identify a Bearer.
+func bearerID(b *modemmanager.Bearer) string { return strconv.Itoa(b.Index) }
+
+// ipConfigs returns the IP configurations reported by b, keyed by the address
+// family label value.
+func ipConfigs(b *modemmanager.Bearer) map[string]*modemmanager.IPConfig {
+	ipcs := make(map[string]*modemmanager.IPConfig, 2)
+	if b.IPv4Config != nil {
+		ipcs["ipv4"] = b.IPv4Config
+	}
+	if b.IPv6Config != nil {
+		ipcs["ipv6"] = b.IPv6Config
+	}
+
+	return ipcs
+}
+
+// bearerMTU returns the MTU reported by b's IPv4 or IPv6 configuration, or 0
+// if no MTU is reported.
+func bearerMTU(b *modemmanager.Bearer) int {
+	for _, ipc := range []*modemmanager.IPConfig{b.IPv4Config, b.IPv6Config} {
+		if ipc != nil && ipc.MTU > 0 {
+			return ipc.MTU
+		}
+	}
+
+	return 0
+}
+
+// bearerStats collects a statistic chosen by fn for each Bearer which reports
+// statistics.
+func bearerStats(
+	c func(value float64, labels ...string),
+	id string,
+	bs []*modemmanager.Bearer,
+	fn func(bs *modemmanager.BearerStats) float64,
+) {
+	for _, b := range bs {
+		// Not all bearers support statistics collection.
+		if b.Stats == nil {
+			continue
+		}
+
+		c(fn(b.Stats), id, bearerID(b))
+	}
+}
+
+// scrapes collects the scrape counts by result for a modem.
+func scrapes(c func(value float64, labels ...string), id string, d *modemData) {
+	c(float64(d.successes), id, "success")
+	c(float64(d.failures), id, "error")
+}
+
+// portInfo collects a Modem's network port info metrics.
+func portInfo(c func(value float64, labels ...string), id string, m *modemmanager.Modem) {
+	for _, p := range m.Ports {
+		// Only export information about network ports because they can be
+		// joined with other metrics such as those from node_exporter. It isn't
+		// clear that exporting AT, MBIM, etc. would be useful at this point.
+		if p.Type != modemmanager.PortTypeNet {
+			continue
+		}
+
+		c(1.0, id, p.Name)
+	}
+}
+
+// portType returns the label value for a PortType.
+func portType(t modemmanager.PortType) string {
+	switch t {
+	case modemmanager.PortTypeNet:
+		return "net"
+	case modemmanager.PortTypeAT:
+		return "at"
+	case modemmanager.PortTypeQCDM:
+		return "qcdm"
+	case modemmanager.PortTypeGPS:
+		return "gps"
+	case modemmanager.PortTypeQMI:
+		return "qmi"
+	case modemmanager.PortTypeMBIM:
+		return "mbim"
+	case modemmanager.PortTypeAudio:
+		return "audio"
+	default:
+		return "unknown"
+	}
+}
+
+// powerStates are the power states of a modem and their metric label values.
+var powerStates = []struct {
+	s  string
+	ps modemmanager.PowerState
+}{
+	{
+		s:  "unknown",
+		ps: modemmanager.PowerStateUnknown,
+	},
+	{
+		s:  "off",
+		ps: modemmanager.PowerStateOff,
+	},
+	{
+		s:  "low",
+		ps: modemmanager.PowerStateLow,
+	},
+	{
+		s:  "on",
+		ps: modemmanager.PowerStateOn,
+	},
+}
+
+// powerState collects a Modem's power state metrics as an enum.
+func powerState(c func(value float64, labels ...string), id string, m *modemmanager.Modem) {
+	// Export all power states but note the active one with a value of 1.0.
+	for _, s := range powerStates {
+		var f float64
+		if s.ps == m.PowerState {
+			f = 1.0
+		}
+
+		c(f, id, s.s)
+	}
+}
+
+// modemStates are the states of a modem and their metric label values.
+var modemStates = []struct {
+	s  string
+	st modemmanager.State
+}{
+	{
+		s:  "failed",
+		st: modemmanager.StateFailed,
+	},
+	{
+		s:  "unknown",
+		st: modemmanager.StateUnknown,
+	},
+	{
+		s:  "locked",
+		st: modemmanager.StateLocked,
+	},
+	{
+		s:  "disabled",
+		st: modemmanager.StateDisabled,
+	},
+	{
+		s:  "disabling",
+		st: modemmanager.StateDisabling,
+	},
+	{
+		s:  "enabling",
+		st: modemmanager.StateEnabling,
+	},
+	{
+		s:  "enabled",
+		st: modemmanager.StateEnabled,
+	},
+	{
+		s:  "searching",
+		st: modemmanager.StateSearching,
+	},
+	{
+		s:  "registered",
+		st: modemmanager.StateRegistered,
+	},
+	{
+		s:  "disconnecting",
+		st: modemmanager.StateDisconnecting,
+	},
+	{
+		s:  "connecting",
+		st: modemmanager.StateConnecting,
+	},
+	{
+		s:  "connected",
+		st: modemmanager.StateConnected,
+	},
+}
+
+// state collects a Modem's state metrics as an enum.
+func state(c func(value float64, labels ...string), id string, m *modemmanager.Modem) {
+	// Export all states but note the active one with a value of 1.0.
+	for _, s := range modemStates {
+		var f float64
+		if s.st == m.State {
+			f = 1.0
+		}
+
+		c(f, id, s.s)
+	}
+}
+
+// Units for extended signal strength measurements.
+const (
+	unitDB  = "dB"
+	unitDBm = "dBm"
+)
+
+// A signalMetric describes an extended signal strength measurement for a
+// cellular technology, from which its metric help text is generated.
+type signalMetric struct {
+	name                    string
+	technology, measurement string
+	description, unit       string
+	value                   func(s *modemmanager.Signal) float64
+}
+
+// signalMetrics are the extended signal strength measurements exported for
+// each modem.
+var signalMetrics = []signalMetric{
+	{
+		name:        mmModemSignalLTERSRQ,
+		technology:  "LTE",
+		measurement: "RSRQ",
+		description: "Reference Signal Received Quality",
+		unit:        unitDB,
+		value:       func(s *modemmanager.Signal) float64 { return s.LTE.RSRQ },
+	},
+	{
+		name:        mmModemSignalLTERSRP,
+		technology:  "LTE",
+		measurement: "RSRP",
+		description: "Reference Signal Received Power",
+		unit:        unitDBm,
+		value:       func(s *modemmanager.Signal) float64 { return s.LTE.RSRP },
+	},
+	{
+		name:        mmModemSignalLTERSSI,
+		technology:  "LTE",
+		measurement: "RSSI",
+		description: "Received Signal Strength Indication",
+		unit:        unitDBm,
+		value:       func(s *modemmanager.Signal) float64 { return s.LTE.RSSI },
+	},
+	{
+		name:        mmModemSignalLTESNR,
+		technology:  "LTE",
+		measurement: "SNR",
+		description: "Signal-to-Noise Ratio",
+		unit:        unitDB,
+		value:       func(s *modemmanager.Signal) float64 { return s.LTE.SNR },
+	},
+}
+
+// help returns the metric help text for sm.
+func (sm signalMetric) help() string {
+	return fmt.Sprintf("A modem's current %s signal %s (%s) in %s.",
+		sm.technology, sm.measurement, sm.description, sm.unit)
+}
+
+// lookupSignalMetric returns the signalMetric with the input metric name.
+func lookupSignalMetric(name string) (signalMetric, bool) {
+	for _, sm := range signalMetrics {
+		if sm.name == name {
+			return sm, true
+		}
+	}
+
+	return signalMetric{}, false
+}
+
+// The 3GPP TS 36.133 reporting ranges for LTE signal measurements, used to
+// normalize the measurements to a ratio.
+const (
+	lteRSRPMin, lteRSRPMax = -140.0, -44.0
+	lteRSRQMin, lteRSRQMax = -19.5, -3.0
+)
+
+// staleMetrics returns a copy of metrics which labels the data metrics for d as
+// fresh and records their samples in fresh. If gathering data failed, the data
+// metrics samples from the last successful scrape within the stale grace period
+// are exported immediately and labeled as stale.
+func (c *collector) staleMetrics(metrics map[string]func(value float64, labels ...string), d *modemData, fresh *[]sample) map[string]func(value float64, labels ...string) {
+	if d.err != nil {
+		for _, s := range c.lastGood(d.state) {
+			metrics[s.name](s.value, append(s.labels, "true")...)
+		}
+
+		return metrics
+	}
+
+	out := make(map[string]func(value float64, labels ...string), len(metrics))
+	for name, fn := range metrics {
+		if !dataMetrics[name] {
+			out[name] = fn
+			continue
+		}
+
+		// Shadow name and fn for each closure.
+		name, fn := name, fn
+		out[name] = func(value float64, labels ...string) {
+			labels = labels[:len(labels):len(labels)]
+			*fresh = append(*fresh, sample{
+				name:   name,
+				value:  value,
+				labels: labels,
+			})
+			fn(value, append(labels, "false")...)
+		}
+	}
+
+	return out
+}
+
+// validSignal reports whether the extended signal strength data s for m is
+// meaningful: m must be registered with a network and s must not be all zero.
+func validSignal(m *modemmanager.Modem, s *modemmanager.Signal) bool {
+	if s == nil || m.State < modemmanager.StateRegistered {
+		return false
+	}
+
+	return s.LTE.RSRP != 0 || s.LTE.RSRQ != 0 || s.LTE.RSSI != 0 || s.LTE.SNR != 0
+}
+
+// A ring is a fixed-size ring buffer of samples, which overwrites the oldest
+// sample once full.
+type ring struct {
+	samples []float64
+	next    int
+	full    bool
+}
+
+// newRing creates a ring which holds up to n samples.
+func newRing(n int) *ring {
+	return &ring{samples: make([]float64, n)}
+}
+
+// add adds v to the ring, overwriting the oldest sample if the ring is full.
+func (r *ring) add(v float64) {
+	r.samples[r.next] = v
+	r.next = (r.next + 1) % len(r.samples)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// values returns a copy of the samples in the ring, from oldest to newest.
+func (r *ring) values() []float64 {
+	if !r.full {
+		return append([]float64(nil), r.samples[:r.next]...)
+	}
+
+	return append(append([]float64(nil), r.samples[r.next:]...), r.samples[:r.next]...)
+}
+
+// summarize returns the minimum, maximum, and average of the non-empty vs.
+func summarize(vs []float64) (min, max, avg float64) {
+	min, max = vs[0], vs[0]
+
+	var sum float64
+	for _, v := range vs {
+		if v < min {
+			min = v
+		}
+		if v > max {
+			max = v
+		}
+
+		sum += v
+	}
+
+	return min, max, sum / float64(len(vs))
+}
+
+// signalRatio normalizes a signal measurement v within the range [lo, hi] to
+// a ratio from 0 to 1, clamping any values outside of the range.
+func signalRatio(v, lo, hi float64) float64 {
+	switch {
+	case v <= lo:
+		return 0
+	case v >= hi:
+		return 1
+	default:
+		return (v - lo) / (hi - lo)
+	}
+}
+
+// boolFloat converts a boolean to a float64 value of 0 or 1.
+func boolFloat(b bool) float64 {
+	if b {
+		return 1.0
+	}
+
+	return 0.0
+}
+
 func panicf(format string, a ...interface{}) {
 	panic(fmt.Sprintf(format, a...))
 }
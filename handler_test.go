@@ -1,17 +1,33 @@
 package modemmanagerexporter
 
 import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/godbus/dbus/v5"
 	"github.com/google/go-cmp/cmp"
 	"github.com/mdlayher/metricslite"
 	"github.com/mdlayher/modemmanager"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 func TestMetrics(t *testing.T) {
+	c := testCollector(nil)
+	c.now = func() time.Time { return time.Unix(10, 0) }
+
 	mm := metricslite.NewMemory()
-	register(mm)
+	c.register(mm)
 
 	// Scrape metrics into memory using canned data so we can compare against
 	// known outputs.
@@ -22,11 +38,13 @@ func TestMetrics(t *testing.T) {
 		s.LTE.RSSI = -81
 		s.LTE.SNR = 1
 
-		scrape(
-			metrics,
-			&modemmanager.Modem{
+		c.scrape(metrics, &modemData{
+			m: &modemmanager.Modem{
 				DeviceIdentifier:    "foo",
 				EquipmentIdentifier: "deadbeef",
+				HardwareRevision:    "10000",
+				Index:               1,
+				Manufacturer:        "Test Manufacturer",
 				Model:               "Test Modem",
 				Ports: []modemmanager.Port{
 					{
@@ -38,13 +56,54 @@ func TestMetrics(t *testing.T) {
 						Type: modemmanager.PortTypeNet,
 					},
 				},
-				PowerState: modemmanager.PowerStateOn,
-				State:      modemmanager.StateConnected,
-				Revision:   "2020-07-17",
+				PowerState:  modemmanager.PowerStateOn,
+				PrimaryPort: "cdc-wdm0",
+				State:       modemmanager.StateConnected,
+				Revision:    "2020-07-17",
+			},
+			now:              time.Unix(1, 0),
+			s:                &s,
+			stateChanged:     time.Unix(2, 0),
+			lastScrape:       time.Unix(3, 0),
+			successes:        2,
+			failures:         1,
+			powerTransitions: map[modemmanager.PowerState]uint64{modemmanager.PowerStateLow: 2},
+			rsrp:             []float64{-120, -116},
+			signalLost:       1,
+			bs: []*modemmanager.Bearer{
+				{
+					Index:     0,
+					Connected: true,
+					Interface: "wwan0",
+					// Dual-stack bearer.
+					IPv4Config: &modemmanager.IPConfig{
+						Address: mustCIDR("192.0.2.1/24"),
+						DNS: []net.IP{
+							net.IPv4(192, 0, 2, 53),
+							net.IPv4(198, 51, 100, 53),
+						},
+					},
+					IPv6Config: &modemmanager.IPConfig{
+						Address: mustCIDR("2001:db8::1/64"),
+						MTU:     1430,
+					},
+					Stats: &modemmanager.BearerStats{
+						Duration: 1 * time.Hour,
+						RXBytes:  2048,
+						TXBytes:  1024,
+					},
+				},
+				{
+					// No statistics available, and disconnected so the MTU
+					// is not reported.
+					Index:     1,
+					Interface: "wwan1",
+					IPv4Config: &modemmanager.IPConfig{
+						MTU: 1500,
+					},
+				},
 			},
-			time.Unix(1, 0),
-			&s,
-		)
+		})
 		return nil
 	})
 
@@ -53,12 +112,66 @@ func TestMetrics(t *testing.T) {
 			// Never collected because this metric is not per-modem.
 			Samples: map[string]float64{},
 		},
+		mmModemBearerAddressInfo: {
+			Samples: map[string]float64{
+				"device_id=foo,bearer=0,family=ipv4,address=192.0.2.1":   1,
+				"device_id=foo,bearer=0,family=ipv6,address=2001:db8::1": 1,
+			},
+		},
+		mmModemBearerConnected: {
+			Samples: map[string]float64{
+				"device_id=foo,bearer=0": 1,
+				"device_id=foo,bearer=1": 0,
+			},
+		},
+		mmModemBearerDuration: {
+			Samples: map[string]float64{"device_id=foo,bearer=0": 3600},
+		},
+		mmModemBearerDNSInfo: {
+			Samples: map[string]float64{
+				"device_id=foo,bearer=0,dns=192.0.2.53":    1,
+				"device_id=foo,bearer=0,dns=198.51.100.53": 1,
+			},
+		},
+		mmModemBearerInfo: {
+			Samples: map[string]float64{
+				"device_id=foo,bearer=0,interface=wwan0": 1,
+				"device_id=foo,bearer=1,interface=wwan1": 1,
+			},
+		},
+		mmModemBearerMTU: {
+			Samples: map[string]float64{"device_id=foo,bearer=0": 1430},
+		},
+		mmModemBearerRXBytes: {
+			Samples: map[string]float64{"device_id=foo,bearer=0": 2048},
+		},
+		mmModemBearerTXBytes: {
+			Samples: map[string]float64{"device_id=foo,bearer=0": 1024},
+		},
+		mmModemBearersTotal: {
+			Samples: map[string]float64{"device_id=foo": 2},
+		},
+		mmModemConnected: {
+			Samples: map[string]float64{"device_id=foo": 1},
+		},
+		mmModemEnabled: {
+			Samples: map[string]float64{"device_id=foo": 1},
+		},
 		mmModemInfo: {
-			Samples: map[string]float64{"device_id=foo,firmware=2020-07-17,imei=deadbeef,model=Test Modem": 1},
+			Samples: map[string]float64{"device_id=foo,firmware=2020-07-17,imei=deadbeef,model=Test Modem,manufacturer=Test Manufacturer,hardware_revision=10000,index=1": 1},
+		},
+		mmModemLastScrape: {
+			Samples: map[string]float64{"device_id=foo": 3},
 		},
 		mmModemNetworkPortInfo: {
 			Samples: map[string]float64{"device_id=foo,device=wwan0": 1},
 		},
+		mmModemPortInfo: {
+			Samples: map[string]float64{
+				"device_id=foo,port=ttyUSB0,type=at": 1,
+				"device_id=foo,port=wwan0,type=net":  1,
+			},
+		},
 		mmModemPowerState: {
 			Samples: map[string]float64{
 				"device_id=foo,state=low":     0,
@@ -67,6 +180,26 @@ func TestMetrics(t *testing.T) {
 				"device_id=foo,state=unknown": 0,
 			},
 		},
+		mmModemPowerStateTransitions: {
+			Samples: map[string]float64{
+				"device_id=foo,to_state=low":     2,
+				"device_id=foo,to_state=off":     0,
+				"device_id=foo,to_state=on":      0,
+				"device_id=foo,to_state=unknown": 0,
+			},
+		},
+		mmModemPrimaryPortInfo: {
+			Samples: map[string]float64{"device_id=foo,port=cdc-wdm0": 1},
+		},
+		mmModemScrapeError: {
+			Samples: map[string]float64{"device_id=foo": 0},
+		},
+		mmModemScrapes: {
+			Samples: map[string]float64{
+				"device_id=foo,result=error":   1,
+				"device_id=foo,result=success": 2,
+			},
+		},
 		mmModemState: {
 			Samples: map[string]float64{
 				"device_id=foo,state=connected":     1,
@@ -83,33 +216,1942 @@ func TestMetrics(t *testing.T) {
 				"device_id=foo,state=unknown":       0,
 			},
 		},
+		mmModemStateChanged: {
+			Samples: map[string]float64{"device_id=foo": 2},
+		},
 		mmModemSignalLTERSRP: {
 			Samples: map[string]float64{"device_id=foo": -116},
 		},
+		mmModemSignalLTERSRPAvg: {
+			Samples: map[string]float64{"device_id=foo": -118},
+		},
+		mmModemSignalLTERSRPMax: {
+			Samples: map[string]float64{"device_id=foo": -116},
+		},
+		mmModemSignalLTERSRPMin: {
+			Samples: map[string]float64{"device_id=foo": -120},
+		},
+		mmModemSignalLTERSRPRatio: {
+			Samples: map[string]float64{"device_id=foo": 0.25},
+		},
 		mmModemSignalLTERSRQ: {
 			Samples: map[string]float64{"device_id=foo": -17},
 		},
+		mmModemSignalLTERSRQRatio: {
+			Samples: map[string]float64{"device_id=foo": 2.5 / 16.5},
+		},
 		mmModemSignalLTERSSI: {
 			Samples: map[string]float64{"device_id=foo": -81},
 		},
 		mmModemSignalLTESNR: {
 			Samples: map[string]float64{"device_id=foo": 1},
 		},
+		mmModemSignalLost: {
+			Samples: map[string]float64{"device_id=foo": 1},
+		},
+
 		mmModemNetworkTimestamp: {
 			Samples: map[string]float64{"device_id=foo": 1},
 		},
+		mmModemNetworkTimeSkew: {
+			Samples: map[string]float64{"device_id=foo": -9},
+		},
+		mmModemSignalPollingActive: {
+			// Never collected because no signal rate is configured.
+			Samples: map[string]float64{},
+		},
+		mmModemSignalSetupOK: {
+			// Never collected because no signal rate is configured.
+			Samples: map[string]float64{},
+		},
+		mmModemSignalSetupRate: {
+			// Never collected because no signal rate is configured.
+			Samples: map[string]float64{},
+		},
+		mmModemsTotal: {
+			// Never collected because this metric is not per-modem.
+			Samples: map[string]float64{},
+		},
+		mmScrapeDuration: {
+			// Never collected because this metric is not per-modem.
+			Samples: map[string]float64{},
+		},
+		mmScrapeErrors: {
+			// Never collected because this metric is not per-modem.
+			Samples: map[string]float64{},
+		},
+		mmScrapeSuccess: {
+			// Never collected because this metric is not per-modem.
+			Samples: map[string]float64{},
+		},
+		mmSignalRefreshRate: {
+			// Never collected because this metric is not per-modem.
+			Samples: map[string]float64{},
+		},
+		mmStartTimestamp: {
+			// Never collected because this metric is not per-modem.
+			Samples: map[string]float64{},
+		},
+		mmUp: {
+			// Never collected because this metric is not per-modem.
+			Samples: map[string]float64{},
+		},
+	}
+
+	if diff := cmp.Diff(want, series(mm)); diff != "" {
+		t.Fatalf("unexpected timeseries (-want +got):\n%s", diff)
+	}
+}
+
+func TestMetricsModemError(t *testing.T) {
+	c := testCollector(nil)
+
+	mm := metricslite.NewMemory()
+	c.register(mm)
+
+	// One modem reports an error while the other succeeds, so only the healthy
+	// modem should produce a full set of metrics.
+	mm.OnConstScrape(func(metrics map[string]func(value float64, labels ...string)) error {
+		c.scrape(metrics, &modemData{
+			m:   &modemmanager.Modem{DeviceIdentifier: "bar"},
+			err: errors.New("failed to get network time"),
+		})
+
+		c.scrape(metrics, &modemData{
+			m:   &modemmanager.Modem{DeviceIdentifier: "foo"},
+			now: time.Unix(1, 0),
+			s:   &modemmanager.Signal{},
+		})
+		return nil
+	})
+
+	got := series(mm)
+
+	wantErrors := map[string]float64{
+		"device_id=bar": 1,
+		"device_id=foo": 0,
+	}
+
+	if diff := cmp.Diff(wantErrors, got[mmModemScrapeError].Samples); diff != "" {
+		t.Fatalf("unexpected scrape error samples (-want +got):\n%s", diff)
+	}
+
+	wantTimestamps := map[string]float64{"device_id=foo": 1}
+
+	if diff := cmp.Diff(wantTimestamps, got[mmModemNetworkTimestamp].Samples); diff != "" {
+		t.Fatalf("unexpected network timestamp samples (-want +got):\n%s", diff)
+	}
+}
+
+func TestCollectorLockedModem(t *testing.T) {
+	c := testCollector(nil)
+	fakeModems(c, &modemmanager.Modem{
+		DeviceIdentifier: "foo",
+		PowerState:       modemmanager.PowerStateOn,
+		State:            modemmanager.StateLocked,
+	})
+
+	// A locked modem cannot report its signal strength.
+	c.signal = func(_ *modemmanager.Modem, _ context.Context) (*modemmanager.Signal, error) {
+		return nil, errors.New("SIM PIN required")
+	}
+
+	mm := metricslite.NewMemory()
+	c.register(mm)
+	mm.OnConstScrape(c.onScrape)
+
+	got := series(mm)
+
+	// Metrics derived from the modem's properties are still reported.
+	if diff := cmp.Diff(map[string]float64{"device_id=foo": 1}, got[mmModemScrapeError].Samples); diff != "" {
+		t.Fatalf("unexpected scrape error samples (-want +got):\n%s", diff)
+	}
+
+	if _, ok := got[mmModemInfo].Samples["device_id=foo,firmware=,imei=,model=,manufacturer=,hardware_revision=,index=0"]; !ok {
+		t.Fatalf("missing info sample: %v", got[mmModemInfo].Samples)
+	}
+
+	for name, key := range map[string]string{
+		mmModemState:      "device_id=foo,state=locked",
+		mmModemPowerState: "device_id=foo,state=on",
+	} {
+		if v := got[name].Samples[key]; v != 1 {
+			t.Fatalf("%s: unexpected value for %q: %v", name, key, v)
+		}
+	}
+
+	// Metrics derived from data gathered from the modem are not.
+	for _, name := range []string{mmModemNetworkTimestamp, mmModemSignalLTERSRP, mmModemBearersTotal} {
+		if diff := cmp.Diff(map[string]float64{}, got[name].Samples); diff != "" {
+			t.Fatalf("unexpected %s samples (-want +got):\n%s", name, diff)
+		}
+	}
+}
+
+func TestCollectorScrape(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		info    map[string]float64
+		success float64
+		up      float64
+		errors  map[string]float64
+	}{
+		{
+			name:    "OK no modems",
+			info:    map[string]float64{"version=1.20.0": 1},
+			success: 1,
+			up:      1,
+			errors:  map[string]float64{"": 0},
+		},
+		{
+			name: "modem error",
+			err:  errors.New("D-Bus failure"),
+			// The ScrapeError is reported on the info metric.
+			info:    map[string]float64{"": -1},
+			success: 0,
+			up:      1,
+			errors:  map[string]float64{"": 1},
+		},
+		{
+			name:    "ModemManager unavailable",
+			err:     dbus.Error{Name: serviceUnknownError},
+			info:    map[string]float64{"": -1},
+			success: 0,
+			up:      0,
+			errors:  map[string]float64{"": 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testCollector(nil)
+			c.version = func() string { return "1.20.0" }
+			c.forEachModem = func(_ context.Context, _ func(context.Context, *modemmanager.Modem) error) error {
+				return tt.err
+			}
+
+			mm := metricslite.NewMemory()
+			c.register(mm)
+			mm.OnConstScrape(c.onScrape)
+
+			got := series(mm)
+
+			if diff := cmp.Diff(tt.info, got[mmInfo].Samples); diff != "" {
+				t.Fatalf("unexpected info samples (-want +got):\n%s", diff)
+			}
+
+			if diff := cmp.Diff(map[string]float64{"": tt.success}, got[mmScrapeSuccess].Samples); diff != "" {
+				t.Fatalf("unexpected scrape success samples (-want +got):\n%s", diff)
+			}
+
+			// ModemManager is up even when no modems are present, or when
+			// gathering data from a modem fails.
+			if diff := cmp.Diff(map[string]float64{"": tt.up}, got[mmUp].Samples); diff != "" {
+				t.Fatalf("unexpected up samples (-want +got):\n%s", diff)
+			}
+
+			d, ok := got[mmScrapeDuration].Samples[""]
+			if !ok || d < 0 {
+				t.Fatalf("unexpected scrape duration sample: %v (present: %v)", d, ok)
+			}
+
+			if diff := cmp.Diff(tt.errors, got[mmScrapeErrors].Samples); diff != "" {
+				t.Fatalf("unexpected scrape errors samples (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCollectorStartTimestamp(t *testing.T) {
+	// The start time is recorded when the collector connects to ModemManager.
+	before := time.Now()
+	c := testCollector(nil)
+	after := time.Now()
+
+	fakeModems(c)
+
+	mm := metricslite.NewMemory()
+	c.register(mm)
+	mm.OnConstScrape(c.onScrape)
+
+	got, ok := series(mm)[mmStartTimestamp].Samples[""]
+	if !ok {
+		t.Fatal("start timestamp sample was not present")
+	}
+
+	if got < float64(before.Unix()) || got > float64(after.Unix()) {
+		t.Fatalf("start timestamp %v is not between %v and %v", got, before.Unix(), after.Unix())
+	}
+}
+
+func TestMetricsDropInfoLabels(t *testing.T) {
+	c := testCollector(&Config{
+		// device_id cannot be dropped and unknown labels are ignored.
+		DropInfoLabels: []string{"device_id", "firmware", "hardware_revision", "model", "foo"},
+	})
+
+	mm := metricslite.NewMemory()
+	c.register(mm)
+
+	mm.OnConstScrape(func(metrics map[string]func(value float64, labels ...string)) error {
+		c.scrape(metrics, &modemData{
+			m: &modemmanager.Modem{
+				DeviceIdentifier:    "foo",
+				EquipmentIdentifier: "deadbeef",
+				Manufacturer:        "Test Manufacturer",
+				Model:               "Test Modem",
+				Revision:            "2020-07-17",
+			},
+			s: &modemmanager.Signal{},
+		})
+		return nil
+	})
+
+	want := map[string]float64{"device_id=foo,imei=deadbeef,manufacturer=Test Manufacturer,index=0": 1}
+
+	if diff := cmp.Diff(want, series(mm)[mmModemInfo].Samples); diff != "" {
+		t.Fatalf("unexpected info samples (-want +got):\n%s", diff)
+	}
+}
+
+func TestCollectorModemsTotal(t *testing.T) {
+	c := testCollector(&Config{
+		// Excluded modems are still counted.
+		ExcludeModems: regexp.MustCompile(`^baz$`),
+	})
+	fakeModems(c,
+		&modemmanager.Modem{Index: 0, DeviceIdentifier: "foo"},
+		&modemmanager.Modem{Index: 1, DeviceIdentifier: "bar"},
+		&modemmanager.Modem{Index: 2, DeviceIdentifier: "baz"},
+	)
+
+	mm := metricslite.NewMemory()
+	c.register(mm)
+	mm.OnConstScrape(c.onScrape)
+
+	got := series(mm)
+
+	if diff := cmp.Diff(map[string]float64{"": 3}, got[mmModemsTotal].Samples); diff != "" {
+		t.Fatalf("unexpected modems total samples (-want +got):\n%s", diff)
+	}
+
+	wantErrors := map[string]float64{
+		"device_id=bar": 0,
+		"device_id=foo": 0,
+	}
+
+	if diff := cmp.Diff(wantErrors, got[mmModemScrapeError].Samples); diff != "" {
+		t.Fatalf("unexpected scrape error samples (-want +got):\n%s", diff)
+	}
+}
+
+func TestCollectorBearersTotal(t *testing.T) {
+	c := testCollector(nil)
+	fakeModems(c, &modemmanager.Modem{DeviceIdentifier: "foo"})
+
+	c.bearers = func(_ *modemmanager.Modem, _ context.Context) ([]*modemmanager.Bearer, error) {
+		return []*modemmanager.Bearer{{Index: 0}, {Index: 1}, {Index: 2}}, nil
+	}
+
+	mm := metricslite.NewMemory()
+	c.register(mm)
+	mm.OnConstScrape(c.onScrape)
+
+	got := series(mm)
+
+	if diff := cmp.Diff(map[string]float64{"device_id=foo": 3}, got[mmModemBearersTotal].Samples); diff != "" {
+		t.Fatalf("unexpected bearers total samples (-want +got):\n%s", diff)
+	}
+}
+
+func TestCollectorEnabled(t *testing.T) {
+	tests := []struct {
+		name  string
+		state modemmanager.State
+		want  float64
+	}{
+		{
+			name:  "disabled",
+			state: modemmanager.StateDisabled,
+		},
+		{
+			name:  "enabled",
+			state: modemmanager.StateEnabled,
+			want:  1,
+		},
+		{
+			name:  "connected",
+			state: modemmanager.StateConnected,
+			want:  1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testCollector(nil)
+			fakeModems(c, &modemmanager.Modem{
+				DeviceIdentifier: "foo",
+				State:            tt.state,
+			})
+
+			mm := metricslite.NewMemory()
+			c.register(mm)
+			mm.OnConstScrape(c.onScrape)
+
+			want := map[string]float64{"device_id=foo": tt.want}
+			if diff := cmp.Diff(want, series(mm)[mmModemEnabled].Samples); diff != "" {
+				t.Fatalf("unexpected enabled samples (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCollectorConnected(t *testing.T) {
+	tests := []struct {
+		name  string
+		state modemmanager.State
+		want  float64
+	}{
+		{
+			name:  "searching",
+			state: modemmanager.StateSearching,
+		},
+		{
+			name:  "connected",
+			state: modemmanager.StateConnected,
+			want:  1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testCollector(nil)
+			fakeModems(c, &modemmanager.Modem{
+				DeviceIdentifier: "foo",
+				State:            tt.state,
+			})
+
+			mm := metricslite.NewMemory()
+			c.register(mm)
+			mm.OnConstScrape(c.onScrape)
+
+			want := map[string]float64{"device_id=foo": tt.want}
+			if diff := cmp.Diff(want, series(mm)[mmModemConnected].Samples); diff != "" {
+				t.Fatalf("unexpected connected samples (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestSignalRatio(t *testing.T) {
+	tests := []struct {
+		name   string
+		v      float64
+		lo, hi float64
+		want   float64
+	}{
+		{
+			name: "RSRP minimum",
+			v:    -150,
+			lo:   lteRSRPMin,
+			hi:   lteRSRPMax,
+			want: 0,
+		},
+		{
+			name: "RSRP midpoint",
+			v:    -92,
+			lo:   lteRSRPMin,
+			hi:   lteRSRPMax,
+			want: 0.5,
+		},
+		{
+			name: "RSRP maximum",
+			v:    -30,
+			lo:   lteRSRPMin,
+			hi:   lteRSRPMax,
+			want: 1,
+		},
+		{
+			name: "RSRQ midpoint",
+			v:    -11.25,
+			lo:   lteRSRQMin,
+			hi:   lteRSRQMax,
+			want: 0.5,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if diff := cmp.Diff(tt.want, signalRatio(tt.v, tt.lo, tt.hi)); diff != "" {
+				t.Fatalf("unexpected signal ratio (-want +got):\n%s", diff)
+			}
+		})
 	}
+}
+
+func TestSignalMetricUnits(t *testing.T) {
+	// The unit of each measurement, independent of technology, which must
+	// appear as the metric name suffix.
+	units := map[string]string{
+		"RSRP": "_dbm",
+		"RSRQ": "_db",
+		"RSSI": "_dbm",
+		"SNR":  "_db",
+	}
+
+	c := testCollector(nil)
+	fakeModems(c)
 
-	// Clear metrics names and help strings from the output so we can more
-	// concisely test the sample data.
+	mm := metricslite.NewMemory()
+	c.register(mm)
+	mm.OnConstScrape(c.onScrape)
 	got := mm.Series()
-	for k, v := range got {
-		v.Name = ""
-		v.Help = ""
-		got[k] = v
+
+	for _, sm := range signalMetrics {
+		t.Run(sm.name, func(t *testing.T) {
+			suffix, ok := units[sm.measurement]
+			if !ok {
+				t.Fatalf("no known unit for measurement %q", sm.measurement)
+			}
+			if !strings.HasSuffix(sm.name, suffix) {
+				t.Fatalf("metric name %q does not end with unit suffix %q", sm.name, suffix)
+			}
+
+			if _, ok := got[sm.name]; !ok {
+				t.Fatalf("metric %q was not registered", sm.name)
+			}
+
+			if diff := cmp.Diff(sm.help(), got[sm.name].Help); diff != "" {
+				t.Fatalf("unexpected help text (-want +got):\n%s", diff)
+			}
+		})
 	}
+}
 
-	if diff := cmp.Diff(want, got); diff != "" {
-		t.Fatalf("unexpected timeseries (-want +got):\n%s", diff)
+func TestCollectorModemID(t *testing.T) {
+	tests := []struct {
+		name           string
+		useEquipmentID bool
+		id             string
+	}{
+		{
+			name: "device",
+			id:   "foo",
+		},
+		{
+			name:           "equipment",
+			useEquipmentID: true,
+			id:             "deadbeef",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testCollector(&Config{UseEquipmentID: tt.useEquipmentID})
+			fakeModems(c, &modemmanager.Modem{
+				DeviceIdentifier:    "foo",
+				EquipmentIdentifier: "deadbeef",
+				Ports: []modemmanager.Port{{
+					Name: "wwan0",
+					Type: modemmanager.PortTypeNet,
+				}},
+				State: modemmanager.StateConnected,
+			})
+
+			mm := metricslite.NewMemory()
+			c.register(mm)
+			mm.OnConstScrape(c.onScrape)
+
+			got := series(mm)
+
+			// The chosen identifier is used as the device_id label value for
+			// every per-modem metric.
+			key := "device_id=" + tt.id
+			for _, name := range []string{mmModemConnected, mmModemScrapeError} {
+				if _, ok := got[name].Samples[key]; !ok {
+					t.Fatalf("%s: missing sample %q: %v", name, key, got[name].Samples)
+				}
+			}
+
+			wantPorts := map[string]float64{key + ",device=wwan0": 1}
+			if diff := cmp.Diff(wantPorts, got[mmModemNetworkPortInfo].Samples); diff != "" {
+				t.Fatalf("unexpected network port samples (-want +got):\n%s", diff)
+			}
+
+			wantInfo := map[string]float64{key + ",firmware=,imei=deadbeef,model=,manufacturer=,hardware_revision=,index=0": 1}
+			if diff := cmp.Diff(wantInfo, got[mmModemInfo].Samples); diff != "" {
+				t.Fatalf("unexpected info samples (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCollectorSignalSetupDisabled(t *testing.T) {
+	// No signal rate is configured, so the modem configuration must not be
+	// modified.
+	c := testCollector(nil)
+	fakeModems(c, &modemmanager.Modem{
+		DeviceIdentifier: "foo",
+		State:            modemmanager.StateRegistered,
+	})
+
+	c.signalSetup = func(_ *modemmanager.Modem, _ context.Context, _ time.Duration) error {
+		panic("signal setup should not be called")
+	}
+	c.signal = func(_ *modemmanager.Modem, _ context.Context) (*modemmanager.Signal, error) {
+		var s modemmanager.Signal
+		s.LTE.RSRP = -116
+		return &s, nil
+	}
+
+	mm := metricslite.NewMemory()
+	c.register(mm)
+	mm.OnConstScrape(c.onScrape)
+
+	got := series(mm)
+
+	// Whatever signal data the modem provides is still exported.
+	if diff := cmp.Diff(map[string]float64{"device_id=foo": -116}, got[mmModemSignalLTERSRP].Samples); diff != "" {
+		t.Fatalf("unexpected RSRP samples (-want +got):\n%s", diff)
+	}
+
+	for _, name := range []string{mmModemSignalSetupOK, mmModemSignalSetupRate, mmModemSignalPollingActive} {
+		if diff := cmp.Diff(map[string]float64{}, got[name].Samples); diff != "" {
+			t.Fatalf("unexpected %s samples (-want +got):\n%s", name, diff)
+		}
+	}
+}
+
+func TestCollectorSignalPollingActive(t *testing.T) {
+	tests := []struct {
+		name          string
+		config, rate  time.Duration
+		want, refresh float64
+	}{
+		{
+			name:    "matching",
+			config:  5 * time.Second,
+			rate:    5 * time.Second,
+			want:    1,
+			refresh: 5,
+		},
+		{
+			name:    "mismatched",
+			config:  5 * time.Second,
+			rate:    0,
+			refresh: 5,
+		},
+		{
+			// ModemManager rounds the requested rate to whole seconds.
+			name:    "fractional",
+			config:  1500 * time.Millisecond,
+			rate:    2 * time.Second,
+			want:    1,
+			refresh: 2,
+		},
 	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testCollector(&Config{SignalRate: tt.config})
+			fakeModems(c, &modemmanager.Modem{DeviceIdentifier: "foo"})
+
+			// The modem reports its current refresh rate, which may not match
+			// the requested rate.
+			c.signal = func(_ *modemmanager.Modem, _ context.Context) (*modemmanager.Signal, error) {
+				return &modemmanager.Signal{Rate: tt.rate}, nil
+			}
+
+			mm := metricslite.NewMemory()
+			c.register(mm)
+			mm.OnConstScrape(c.onScrape)
+
+			got := series(mm)
+
+			want := map[string]float64{"device_id=foo": tt.want}
+			if diff := cmp.Diff(want, got[mmModemSignalPollingActive].Samples); diff != "" {
+				t.Fatalf("unexpected signal polling active samples (-want +got):\n%s", diff)
+			}
+
+			if diff := cmp.Diff(map[string]float64{"": tt.refresh}, got[mmSignalRefreshRate].Samples); diff != "" {
+				t.Fatalf("unexpected signal refresh rate samples (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCollectorInvalidSignal(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  bool
+		want map[string]float64
+	}{
+		{
+			name: "default",
+			want: map[string]float64{},
+		},
+		{
+			name: "raw",
+			raw:  true,
+			want: map[string]float64{"device_id=foo": -116},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testCollector(&Config{RawSignal: tt.raw})
+			fakeModems(c, &modemmanager.Modem{
+				DeviceIdentifier: "foo",
+				State:            modemmanager.StateSearching,
+			})
+
+			// The modem reports stale signal data while searching for a
+			// network.
+			c.signal = func(_ *modemmanager.Modem, _ context.Context) (*modemmanager.Signal, error) {
+				var s modemmanager.Signal
+				s.LTE.RSRP = -116
+				return &s, nil
+			}
+
+			mm := metricslite.NewMemory()
+			c.register(mm)
+			mm.OnConstScrape(c.onScrape)
+
+			got := series(mm)
+
+			if diff := cmp.Diff(tt.want, got[mmModemSignalLTERSRP].Samples); diff != "" {
+				t.Fatalf("unexpected RSRP samples (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(map[string]float64{"device_id=foo": 0}, got[mmModemScrapeError].Samples); diff != "" {
+				t.Fatalf("unexpected scrape error samples (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestValidSignal(t *testing.T) {
+	var good modemmanager.Signal
+	good.LTE.RSRP = -116
+
+	tests := []struct {
+		name string
+		st   modemmanager.State
+		s    *modemmanager.Signal
+		ok   bool
+	}{
+		{
+			name: "no signal",
+			st:   modemmanager.StateConnected,
+		},
+		{
+			name: "searching",
+			st:   modemmanager.StateSearching,
+			s:    &good,
+		},
+		{
+			name: "all zero",
+			st:   modemmanager.StateConnected,
+			s:    &modemmanager.Signal{},
+		},
+		{
+			name: "OK",
+			st:   modemmanager.StateRegistered,
+			s:    &good,
+			ok:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if diff := cmp.Diff(tt.ok, validSignal(&modemmanager.Modem{State: tt.st}, tt.s)); diff != "" {
+				t.Fatalf("unexpected signal validity (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCollectorSignalLost(t *testing.T) {
+	m := &modemmanager.Modem{
+		DeviceIdentifier: "foo",
+		State:            modemmanager.StateConnected,
+	}
+
+	c := testCollector(nil)
+	fakeModems(c, m)
+
+	var rsrp float64
+	c.signal = func(_ *modemmanager.Modem, _ context.Context) (*modemmanager.Signal, error) {
+		var s modemmanager.Signal
+		s.LTE.RSRP = rsrp
+		return &s, nil
+	}
+
+	mm := metricslite.NewMemory()
+	c.register(mm)
+	mm.OnConstScrape(c.onScrape)
+
+	// The modem starts with a good signal, loses it, and then loses its
+	// registration while the signal is still gone, which is not a new loss.
+	var got []float64
+	for _, tt := range []struct {
+		rsrp float64
+		st   modemmanager.State
+	}{
+		{rsrp: -90, st: modemmanager.StateConnected},
+		{rsrp: 0, st: modemmanager.StateConnected},
+		{rsrp: 0, st: modemmanager.StateSearching},
+		{rsrp: -90, st: modemmanager.StateRegistered},
+		{rsrp: -90, st: modemmanager.StateSearching},
+	} {
+		rsrp, m.State = tt.rsrp, tt.st
+		got = append(got, series(mm)[mmModemSignalLost].Samples["device_id=foo"])
+	}
+
+	if diff := cmp.Diff([]float64{0, 1, 1, 1, 2}, got); diff != "" {
+		t.Fatalf("unexpected signal lost counts (-want +got):\n%s", diff)
+	}
+}
+
+func TestCollectorSignalWindow(t *testing.T) {
+	c := testCollector(&Config{SignalWindow: 3})
+	fakeModems(c, &modemmanager.Modem{
+		DeviceIdentifier: "foo",
+		State:            modemmanager.StateConnected,
+	})
+
+	var rsrp float64
+	c.signal = func(_ *modemmanager.Modem, _ context.Context) (*modemmanager.Signal, error) {
+		var s modemmanager.Signal
+		s.LTE.RSRP = rsrp
+		return &s, nil
+	}
+
+	mm := metricslite.NewMemory()
+	c.register(mm)
+	mm.OnConstScrape(c.onScrape)
+
+	// The first sample falls out of the window by the final scrape.
+	var got map[string]metricslite.Series
+	for _, v := range []float64{-100, -120, -90, -60} {
+		rsrp = v
+		got = series(mm)
+	}
+
+	for name, want := range map[string]float64{
+		mmModemSignalLTERSRPAvg: -90,
+		mmModemSignalLTERSRPMax: -60,
+		mmModemSignalLTERSRPMin: -120,
+	} {
+		if diff := cmp.Diff(map[string]float64{"device_id=foo": want}, got[name].Samples); diff != "" {
+			t.Fatalf("unexpected %s samples (-want +got):\n%s", name, diff)
+		}
+	}
+}
+
+func TestCollectorStateChanged(t *testing.T) {
+	m := &modemmanager.Modem{
+		DeviceIdentifier: "foo",
+		State:            modemmanager.StateConnecting,
+	}
+
+	c := testCollector(nil)
+	fakeModems(c, m)
+
+	var now time.Time
+	c.now = func() time.Time { return now }
+
+	mm := metricslite.NewMemory()
+	c.register(mm)
+	mm.OnConstScrape(c.onScrape)
+
+	// The state changes between the second and third scrapes, so the
+	// timestamp is only updated on the third scrape.
+	var got []float64
+	for i, st := range []modemmanager.State{
+		modemmanager.StateConnecting,
+		modemmanager.StateConnecting,
+		modemmanager.StateConnected,
+	} {
+		now = time.Unix(int64(i+1)*10, 0)
+		m.State = st
+
+		got = append(got, series(mm)[mmModemStateChanged].Samples["device_id=foo"])
+	}
+
+	if diff := cmp.Diff([]float64{10, 10, 30}, got); diff != "" {
+		t.Fatalf("unexpected state changed timestamps (-want +got):\n%s", diff)
+	}
+}
+
+func TestCollectorPowerStateTransitions(t *testing.T) {
+	m := &modemmanager.Modem{
+		DeviceIdentifier: "foo",
+		PowerState:       modemmanager.PowerStateOn,
+	}
+
+	c := testCollector(nil)
+	fakeModems(c, m)
+
+	mm := metricslite.NewMemory()
+	c.register(mm)
+	mm.OnConstScrape(c.onScrape)
+
+	// The first observation is not a transition, and the modem transitions
+	// from on to low between the first and second scrapes.
+	_ = series(mm)
+	m.PowerState = modemmanager.PowerStateLow
+	got := series(mm)
+
+	want := map[string]float64{
+		"device_id=foo,to_state=low":     1,
+		"device_id=foo,to_state=off":     0,
+		"device_id=foo,to_state=on":      0,
+		"device_id=foo,to_state=unknown": 0,
+	}
+
+	if diff := cmp.Diff(want, got[mmModemPowerStateTransitions].Samples); diff != "" {
+		t.Fatalf("unexpected power state transitions (-want +got):\n%s", diff)
+	}
+}
+
+func TestCollectorNetworkTimeSkew(t *testing.T) {
+	c := testCollector(nil)
+	fakeModems(c, &modemmanager.Modem{DeviceIdentifier: "foo"})
+
+	// The modem reports a network time which lags far behind the exporter's
+	// clock.
+	now := time.Unix(1000, 0)
+	c.now = func() time.Time { return now }
+	c.networkTime = func(_ *modemmanager.Modem, _ context.Context) (time.Time, error) {
+		return now.Add(-90 * time.Second), nil
+	}
+
+	mm := metricslite.NewMemory()
+	c.register(mm)
+	mm.OnConstScrape(c.onScrape)
+
+	got := series(mm)
+
+	if diff := cmp.Diff(map[string]float64{"device_id=foo": -90}, got[mmModemNetworkTimeSkew].Samples); diff != "" {
+		t.Fatalf("unexpected network time skew samples (-want +got):\n%s", diff)
+	}
+}
+
+func TestCollectorPrune(t *testing.T) {
+	c := testCollector(&Config{
+		SignalRate:       5 * time.Second,
+		StaleGracePeriod: time.Minute,
+	})
+	fakeModems(c)
+
+	var now time.Time
+	c.now = func() time.Time { return now }
+
+	// Modem bar is removed after the first scrape.
+	modems := []*modemmanager.Modem{
+		{Index: 0, DeviceIdentifier: "foo"},
+		{Index: 1, DeviceIdentifier: "bar"},
+	}
+	c.forEachModem = func(ctx context.Context, fn func(context.Context, *modemmanager.Modem) error) error {
+		for _, m := range modems {
+			if err := fn(ctx, m); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	mm := metricslite.NewMemory()
+	c.register(mm)
+	mm.OnConstScrape(c.onScrape)
+
+	// The state of bar is kept during the stale grace period, but is
+	// forgotten after it expires.
+	var got [][]string
+	for i, d := range []time.Duration{0, 30 * time.Second, 61 * time.Second} {
+		if i == 1 {
+			modems = modems[:1]
+		}
+
+		now = time.Unix(0, 0).Add(d)
+		_ = mm.Series()
+
+		var ids []string
+		for id := range c.modems {
+			if _, ok := c.configured[id]; !ok {
+				t.Fatalf("modem %q was not configured", id)
+			}
+
+			ids = append(ids, id)
+		}
+
+		sort.Strings(ids)
+		got = append(got, ids)
+	}
+
+	want := [][]string{
+		{"bar", "foo"},
+		{"bar", "foo"},
+		{"foo"},
+	}
+
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("unexpected modems (-want +got):\n%s", diff)
+	}
+	if len(c.configured) != 1 {
+		t.Fatalf("expected one configured modem, but got: %v", c.configured)
+	}
+}
+
+func TestCollectorPruneConcurrent(t *testing.T) {
+	c := testCollector(nil)
+	fakeModems(c)
+
+	// Each call to the clock advances it so that a modem which is not seen by
+	// a scrape is always pruned.
+	var tick int64
+	c.now = func() time.Time { return time.Unix(atomic.AddInt64(&tick, 1), 0) }
+
+	// Modem bar is unplugged after the first scrape observes it.
+	var calls int32
+	c.forEachModem = func(ctx context.Context, fn func(context.Context, *modemmanager.Modem) error) error {
+		modems := []*modemmanager.Modem{{Index: 0, DeviceIdentifier: "foo"}}
+		if atomic.AddInt32(&calls, 1) == 1 {
+			modems = append(modems, &modemmanager.Modem{Index: 1, DeviceIdentifier: "bar"})
+		}
+
+		for _, m := range modems {
+			if err := fn(ctx, m); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	// The first scrape blocks while gathering data from bar until the second
+	// scrape has pruned it.
+	var (
+		reached = make(chan struct{})
+		release = make(chan struct{})
+	)
+	c.signal = func(m *modemmanager.Modem, _ context.Context) (*modemmanager.Signal, error) {
+		if m.DeviceIdentifier == "bar" {
+			close(reached)
+			<-release
+		}
+
+		return &modemmanager.Signal{}, nil
+	}
+
+	h := newHandler(prometheus.NewRegistry(), newPromCollector(c))
+	scrape := func() string {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		return w.Body.String()
+	}
+
+	bodyC := make(chan string)
+	go func() { bodyC <- scrape() }()
+
+	<-reached
+	_ = scrape()
+	close(release)
+
+	// The first scrape completes and reports bar even though its state was
+	// pruned by the second scrape.
+	if body := <-bodyC; !strings.Contains(body, `modemmanager_modem_scrape_error{device_id="bar"} 0`) {
+		t.Fatalf("expected bar in first scrape output:\n%s", body)
+	}
+}
+
+func TestCollectorStaleGracePeriod(t *testing.T) {
+	c := testCollector(&Config{StaleGracePeriod: time.Minute})
+	fakeModems(c, &modemmanager.Modem{
+		DeviceIdentifier: "foo",
+		State:            modemmanager.StateConnected,
+	})
+
+	var now time.Time
+	c.now = func() time.Time { return now }
+
+	var err error
+	c.signal = func(_ *modemmanager.Modem, _ context.Context) (*modemmanager.Signal, error) {
+		var s modemmanager.Signal
+		s.LTE.RSRP = -116
+		return &s, err
+	}
+
+	// Samples persist across scrapes in metricslite.Memory, so gather from a
+	// Prometheus registry instead.
+	reg := prometheus.NewPedanticRegistry()
+	if err := reg.Register(newPromCollector(c)); err != nil {
+		t.Fatalf("failed to register collector: %v", err)
+	}
+
+	// The modem is scraped successfully, fails within the grace period, and
+	// then fails after the grace period has elapsed.
+	var got []map[string]float64
+	for _, tt := range []struct {
+		now int64
+		err error
+	}{
+		{now: 0},
+		{now: 30, err: errors.New("D-Bus failure")},
+		{now: 60, err: errors.New("D-Bus failure")},
+	} {
+		now, err = time.Unix(tt.now, 0), tt.err
+
+		mfs, gerr := reg.Gather()
+		if gerr != nil {
+			t.Fatalf("failed to gather metrics: %v", gerr)
+		}
+
+		samples := make(map[string]float64)
+		for _, mf := range mfs {
+			if mf.GetName() != mmModemSignalLTERSRP {
+				continue
+			}
+
+			for _, m := range mf.GetMetric() {
+				var labels []string
+				for _, l := range m.GetLabel() {
+					labels = append(labels, l.GetName()+"="+l.GetValue())
+				}
+
+				samples[strings.Join(labels, ",")] = m.GetGauge().GetValue()
+			}
+		}
+
+		got = append(got, samples)
+	}
+
+	want := []map[string]float64{
+		{"device_id=foo,stale=false": -116},
+		{"device_id=foo,stale=true": -116},
+		{},
+	}
+
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("unexpected RSRP samples (-want +got):\n%s", diff)
+	}
+}
+
+func TestCollectorLastScrape(t *testing.T) {
+	c := testCollector(nil)
+	fakeModems(c, &modemmanager.Modem{DeviceIdentifier: "foo"})
+
+	var (
+		now  time.Time
+		fail bool
+	)
+	c.now = func() time.Time { return now }
+	c.signal = func(_ *modemmanager.Modem, _ context.Context) (*modemmanager.Signal, error) {
+		if fail {
+			return nil, errors.New("D-Bus failure")
+		}
+
+		return &modemmanager.Signal{}, nil
+	}
+
+	mm := metricslite.NewMemory()
+	c.register(mm)
+	mm.OnConstScrape(c.onScrape)
+
+	// The second scrape fails, so the timestamp from the first scrape is
+	// reported until the third scrape succeeds.
+	var got []float64
+	for i, f := range []bool{false, true, false} {
+		now = time.Unix(int64(i+1)*10, 0)
+		fail = f
+
+		got = append(got, series(mm)[mmModemLastScrape].Samples["device_id=foo"])
+	}
+
+	if diff := cmp.Diff([]float64{10, 10, 30}, got); diff != "" {
+		t.Fatalf("unexpected last scrape timestamps (-want +got):\n%s", diff)
+	}
+}
+
+func TestCollectorScrapes(t *testing.T) {
+	c := testCollector(nil)
+	fakeModems(c, &modemmanager.Modem{DeviceIdentifier: "foo"})
+
+	var fail bool
+	c.signal = func(_ *modemmanager.Modem, _ context.Context) (*modemmanager.Signal, error) {
+		if fail {
+			return nil, errors.New("D-Bus failure")
+		}
+
+		return &modemmanager.Signal{}, nil
+	}
+
+	mm := metricslite.NewMemory()
+	c.register(mm)
+	mm.OnConstScrape(c.onScrape)
+
+	// Two scrapes succeed and one fails.
+	var got map[string]float64
+	for _, f := range []bool{false, true, false} {
+		fail = f
+		got = series(mm)[mmModemScrapes].Samples
+	}
+
+	want := map[string]float64{
+		"device_id=foo,result=error":   1,
+		"device_id=foo,result=success": 2,
+	}
+
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("unexpected scrapes samples (-want +got):\n%s", diff)
+	}
+}
+
+func TestCollectorDisableCollectors(t *testing.T) {
+	tests := []struct {
+		name      string
+		collector string
+		disabled  []string
+	}{
+		{
+			name:      "bearers",
+			collector: collectorBearers,
+			disabled: []string{
+				mmModemBearerAddressInfo,
+				mmModemBearerConnected,
+				mmModemBearerDuration,
+				mmModemBearerDNSInfo,
+				mmModemBearerInfo,
+				mmModemBearerMTU,
+				mmModemBearerRXBytes,
+				mmModemBearerTXBytes,
+				mmModemBearersTotal,
+			},
+		},
+		{
+			name:      "network time",
+			collector: collectorNetworkTime,
+			disabled: []string{
+				mmModemNetworkTimeSkew,
+				mmModemNetworkTimestamp,
+			},
+		},
+		{
+			name:      "ports",
+			collector: collectorPorts,
+			disabled: []string{
+				mmModemNetworkPortInfo,
+				mmModemPortInfo,
+				mmModemPrimaryPortInfo,
+			},
+		},
+		{
+			name:      "power state",
+			collector: collectorPowerState,
+			disabled: []string{
+				mmModemPowerState,
+				mmModemPowerStateTransitions,
+			},
+		},
+		{
+			name:      "signal",
+			collector: collectorSignal,
+			disabled: []string{
+				mmModemSignalLTERSRQ,
+				mmModemSignalLTERSRQRatio,
+				mmModemSignalLTERSRP,
+				mmModemSignalLTERSRPAvg,
+				mmModemSignalLTERSRPMax,
+				mmModemSignalLTERSRPMin,
+				mmModemSignalLTERSRPRatio,
+				mmModemSignalLTERSSI,
+				mmModemSignalLTESNR,
+				mmModemSignalLost,
+				mmModemSignalPollingActive,
+				mmModemSignalSetupOK,
+				mmModemSignalSetupRate,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testCollector(&Config{
+				SignalRate:        time.Second,
+				DisableCollectors: []string{tt.collector},
+			})
+			fakeModems(c, &modemmanager.Modem{
+				DeviceIdentifier: "foo",
+				Ports: []modemmanager.Port{{
+					Name: "wwan0",
+					Type: modemmanager.PortTypeNet,
+				}},
+				PrimaryPort: "cdc-wdm0",
+			})
+
+			// Disabled collectors must not query the modem.
+			fail := func(name string) error { panic(name + " should not be queried") }
+			switch tt.collector {
+			case collectorBearers:
+				c.bearers = func(_ *modemmanager.Modem, _ context.Context) ([]*modemmanager.Bearer, error) {
+					return nil, fail("bearers")
+				}
+			case collectorNetworkTime:
+				c.networkTime = func(_ *modemmanager.Modem, _ context.Context) (time.Time, error) {
+					return time.Time{}, fail("network time")
+				}
+			case collectorSignal:
+				c.signal = func(_ *modemmanager.Modem, _ context.Context) (*modemmanager.Signal, error) {
+					return nil, fail("signal")
+				}
+				c.signalSetup = func(_ *modemmanager.Modem, _ context.Context, _ time.Duration) error {
+					return fail("signal setup")
+				}
+			}
+
+			mm := metricslite.NewMemory()
+			c.register(mm)
+			mm.OnConstScrape(c.onScrape)
+
+			got := series(mm)
+
+			for _, name := range tt.disabled {
+				if _, ok := got[name]; ok {
+					t.Fatalf("metric %q should not be registered", name)
+				}
+			}
+
+			if diff := cmp.Diff(map[string]float64{"device_id=foo": 0}, got[mmModemScrapeError].Samples); diff != "" {
+				t.Fatalf("unexpected scrape error samples (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCollectorConcurrency(t *testing.T) {
+	const n = 4
+
+	c := testCollector(&Config{Concurrency: n})
+
+	var modems []*modemmanager.Modem
+	for i := 0; i < n; i++ {
+		modems = append(modems, &modemmanager.Modem{
+			Index:            i,
+			DeviceIdentifier: strconv.Itoa(i),
+			State:            modemmanager.StateConnected,
+		})
+	}
+	fakeModems(c, modems...)
+
+	// Each modem blocks until all of the modems are being scraped at once,
+	// which can only happen if they are scraped concurrently.
+	var (
+		mu      sync.Mutex
+		pending = n
+		ready   = make(chan struct{})
+	)
+
+	c.signal = func(m *modemmanager.Modem, _ context.Context) (*modemmanager.Signal, error) {
+		mu.Lock()
+		if pending--; pending == 0 {
+			close(ready)
+		}
+		mu.Unlock()
+
+		select {
+		case <-ready:
+		case <-time.After(5 * time.Second):
+			return nil, errors.New("timed out waiting for concurrent scrapes")
+		}
+
+		var s modemmanager.Signal
+		s.LTE.RSRP = -100 - float64(m.Index)
+		return &s, nil
+	}
+
+	mm := metricslite.NewMemory()
+	c.register(mm)
+	mm.OnConstScrape(c.onScrape)
+
+	got := series(mm)
+
+	wantErrors := make(map[string]float64)
+	wantRSRP := make(map[string]float64)
+	for _, m := range modems {
+		wantErrors["device_id="+m.DeviceIdentifier] = 0
+		wantRSRP["device_id="+m.DeviceIdentifier] = -100 - float64(m.Index)
+	}
+
+	if diff := cmp.Diff(wantErrors, got[mmModemScrapeError].Samples); diff != "" {
+		t.Fatalf("unexpected scrape error samples (-want +got):\n%s", diff)
+	}
+
+	if diff := cmp.Diff(wantRSRP, got[mmModemSignalLTERSRP].Samples); diff != "" {
+		t.Fatalf("unexpected RSRP samples (-want +got):\n%s", diff)
+	}
+}
+
+func TestHandlerContextCanceled(t *testing.T) {
+	c := testCollector(nil)
+	c.version = func() string { return "1.20.0" }
+
+	// The scrape context should be canceled along with the HTTP request.
+	var got error
+	c.forEachModem = func(ctx context.Context, _ func(context.Context, *modemmanager.Modem) error) error {
+		select {
+		case <-ctx.Done():
+			got = ctx.Err()
+		case <-time.After(5 * time.Second):
+			got = errors.New("context was not canceled")
+		}
+
+		return got
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	h := newHandler(prometheus.NewRegistry(), newPromCollector(c))
+	h.ServeHTTP(
+		httptest.NewRecorder(),
+		httptest.NewRequest(http.MethodGet, "/metrics", nil).WithContext(ctx),
+	)
+
+	if !errors.Is(got, context.Canceled) {
+		t.Fatalf("expected context canceled error, but got: %v", got)
+	}
+}
+
+func TestHandlerModemManagerAbsent(t *testing.T) {
+	// ModemManager was not available at startup, and dialing fails until it
+	// appears.
+	var live *modemmanager.Client
+	mmc := newClient(nil)
+	mmc.dial = func(_ context.Context) (*modemmanager.Client, error) {
+		if live == nil {
+			return nil, errors.New("failed to connect to system bus")
+		}
+
+		return live, nil
+	}
+	mmc.forEachModem = func(_ *modemmanager.Client, _ context.Context, _ func(context.Context, *modemmanager.Modem) error) error {
+		return nil
+	}
+
+	c := testCollector(nil)
+	c.version = mmc.Version
+	c.started = mmc.Connected
+	c.forEachModem = mmc.ForEachModem
+
+	h := newHandler(prometheus.NewRegistry(), newPromCollector(c))
+
+	for _, tt := range []struct {
+		up   string
+		live *modemmanager.Client
+	}{
+		{up: "modemmanager_up 0"},
+		{up: "modemmanager_up 1", live: &modemmanager.Client{Version: "1.20.0"}},
+	} {
+		live = tt.live
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+		if !strings.Contains(w.Body.String(), tt.up+"\n") {
+			t.Fatalf("expected %q in output:\n%s", tt.up, w.Body.String())
+		}
+	}
+}
+
+func TestHandlerForRegisterer(t *testing.T) {
+	c := testCollector(nil)
+	c.version = func() string { return "1.20.0" }
+	fakeModems(c, &modemmanager.Modem{DeviceIdentifier: "foo"})
+
+	reg := prometheus.NewPedanticRegistry()
+	h, err := newHandlerFor(prometheus.WrapRegistererWithPrefix("test_", reg), reg, newPromCollector(c))
+	if err != nil {
+		t.Fatalf("failed to create handler: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	for _, want := range []string{
+		"test_modemmanager_up 1\n",
+		`test_modemmanager_modem_scrape_error{device_id="foo"} 0` + "\n",
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Fatalf("expected %q in output:\n%s", want, w.Body.String())
+		}
+	}
+
+	// The exporter's metrics may only be registered once.
+	if _, err := newHandlerFor(prometheus.WrapRegistererWithPrefix("test_", reg), reg, newPromCollector(c)); err == nil {
+		t.Fatal("expected an error registering duplicate metrics, but none occurred")
+	}
+}
+
+func TestCollectorCallTimeout(t *testing.T) {
+	c := testCollector(&Config{CallTimeout: 10 * time.Millisecond})
+	fakeModems(c,
+		&modemmanager.Modem{Index: 0, DeviceIdentifier: "foo"},
+		&modemmanager.Modem{Index: 1, DeviceIdentifier: "bar"},
+	)
+
+	// Modem foo is slow to respond and only fails if the call is canceled,
+	// but modem bar responds immediately.
+	c.signal = func(m *modemmanager.Modem, ctx context.Context) (*modemmanager.Signal, error) {
+		if m.DeviceIdentifier == "foo" {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(5 * time.Second):
+			}
+		}
+
+		return &modemmanager.Signal{}, nil
+	}
+
+	mm := metricslite.NewMemory()
+	c.register(mm)
+	mm.OnConstScrape(c.onScrape)
+
+	got := series(mm)
+
+	wantErrors := map[string]float64{
+		"device_id=bar": 0,
+		"device_id=foo": 1,
+	}
+
+	if diff := cmp.Diff(wantErrors, got[mmModemScrapeError].Samples); diff != "" {
+		t.Fatalf("unexpected scrape error samples (-want +got):\n%s", diff)
+	}
+
+	if diff := cmp.Diff(map[string]float64{"": 1}, got[mmScrapeSuccess].Samples); diff != "" {
+		t.Fatalf("unexpected scrape success samples (-want +got):\n%s", diff)
+	}
+}
+
+func TestCollectorModemTimeouts(t *testing.T) {
+	c := testCollector(&Config{
+		Timeout:       10 * time.Millisecond,
+		ModemTimeouts: map[string]time.Duration{"bar": 5 * time.Second},
+	})
+	fakeModems(c,
+		&modemmanager.Modem{Index: 0, DeviceIdentifier: "foo"},
+		&modemmanager.Modem{Index: 1, DeviceIdentifier: "bar"},
+	)
+
+	// Both modems are equally slow to respond, but only bar has a timeout long
+	// enough to succeed.
+	c.signal = func(_ *modemmanager.Modem, ctx context.Context) (*modemmanager.Signal, error) {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		return &modemmanager.Signal{}, nil
+	}
+
+	mm := metricslite.NewMemory()
+	c.register(mm)
+	mm.OnConstScrape(c.onScrape)
+
+	got := series(mm)
+
+	wantErrors := map[string]float64{
+		"device_id=bar": 0,
+		"device_id=foo": 1,
+	}
+
+	if diff := cmp.Diff(wantErrors, got[mmModemScrapeError].Samples); diff != "" {
+		t.Fatalf("unexpected scrape error samples (-want +got):\n%s", diff)
+	}
+
+	if diff := cmp.Diff(map[string]float64{"": 1}, got[mmScrapeSuccess].Samples); diff != "" {
+		t.Fatalf("unexpected scrape success samples (-want +got):\n%s", diff)
+	}
+}
+
+func TestCollectorCache(t *testing.T) {
+	c := testCollector(&Config{CacheInterval: time.Minute})
+	fakeModems(c)
+
+	// Each poll reports a different modem so cached data can be identified.
+	var polls int
+	c.forEachModem = func(ctx context.Context, fn func(context.Context, *modemmanager.Modem) error) error {
+		polls++
+		return fn(ctx, &modemmanager.Modem{DeviceIdentifier: strconv.Itoa(polls)})
+	}
+
+	var now time.Time
+	c.now = func() time.Time { return now }
+
+	mm := metricslite.NewMemory()
+	c.register(mm)
+	mm.OnConstScrape(c.onScrape)
+
+	// The second scrape is served from the cache, but the cache has expired
+	// by the third scrape so the modems are polled again.
+	var got []map[string]float64
+	for _, d := range []time.Duration{0, 30 * time.Second, 61 * time.Second} {
+		now = time.Unix(0, 0).Add(d)
+		got = append(got, series(mm)[mmModemScrapeError].Samples)
+	}
+
+	if polls != 2 {
+		t.Fatalf("expected modems to be polled twice, but got: %d", polls)
+	}
+
+	want := []map[string]float64{
+		{"device_id=1": 0},
+		{"device_id=1": 0},
+		// metricslite.Memory retains samples from previous scrapes.
+		{"device_id=1": 0, "device_id=2": 0},
+	}
+
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("unexpected scrape error samples (-want +got):\n%s", diff)
+	}
+}
+
+func TestCollectorCacheCanceled(t *testing.T) {
+	c := testCollector(&Config{CacheInterval: time.Minute})
+	fakeModems(c)
+
+	var (
+		polls int
+		err   error
+	)
+	c.forEachModem = func(ctx context.Context, _ func(context.Context, *modemmanager.Modem) error) error {
+		polls++
+		err = ctx.Err()
+		return nil
+	}
+
+	h := newHandler(prometheus.NewRegistry(), newPromCollector(c))
+
+	// The first client disconnects before the cache is refreshed, but the
+	// refresh completes and is served to the next client.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for _, ctx := range []context.Context{ctx, context.Background()} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil).WithContext(ctx))
+	}
+
+	if err != nil {
+		t.Fatalf("cache refresh was canceled: %v", err)
+	}
+	if polls != 1 {
+		t.Fatalf("expected modems to be polled once, but got: %d", polls)
+	}
+}
+
+func TestCollectorCacheFailedRefresh(t *testing.T) {
+	c := testCollector(&Config{CacheInterval: time.Minute})
+	fakeModems(c)
+
+	// The first refresh blocks until more scrapes are waiting on the cache,
+	// and every refresh fails.
+	var (
+		polls   int32
+		reached = make(chan struct{})
+		release = make(chan struct{})
+	)
+	c.forEachModem = func(_ context.Context, _ func(context.Context, *modemmanager.Modem) error) error {
+		if atomic.AddInt32(&polls, 1) == 1 {
+			close(reached)
+			<-release
+		}
+
+		return errors.New("D-Bus failure")
+	}
+
+	h := newHandler(prometheus.NewRegistry(), newPromCollector(c))
+	scrape := func() string {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		return w.Body.String()
+	}
+
+	const n = 4
+	bodyC := make(chan string, n)
+	go func() { bodyC <- scrape() }()
+	<-reached
+
+	for i := 1; i < n; i++ {
+		go func() { bodyC <- scrape() }()
+	}
+
+	// Give the waiting scrapes time to queue behind the refresh.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	// Every waiting scrape shares the failed refresh rather than gathering
+	// again in turn.
+	for i := 0; i < n; i++ {
+		if body := <-bodyC; !strings.Contains(body, "modemmanager_scrape_success 0\n") {
+			t.Fatalf("expected failed scrape in output:\n%s", body)
+		}
+	}
+
+	if got := atomic.LoadInt32(&polls); got != 1 {
+		t.Fatalf("expected modems to be polled once, but got: %d", got)
+	}
+
+	// The failure is not cached, so the next scrape tries again.
+	_ = scrape()
+	if got := atomic.LoadInt32(&polls); got != 2 {
+		t.Fatalf("expected modems to be polled twice, but got: %d", got)
+	}
+}
+
+func TestCollectorRetry(t *testing.T) {
+	tests := []struct {
+		name    string
+		retries int
+		err     error
+		calls   int
+		ok      bool
+	}{
+		{
+			name:    "transient OK",
+			retries: 2,
+			err:     dbus.Error{Name: noReplyError},
+			calls:   3,
+			ok:      true,
+		},
+		{
+			name:    "transient retries exhausted",
+			retries: 1,
+			err:     dbus.Error{Name: noReplyError},
+			calls:   2,
+		},
+		{
+			name:    "not transient",
+			retries: 2,
+			err:     errors.New("permission denied"),
+			calls:   1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testCollector(&Config{Retries: tt.retries})
+			c.retryDelay = time.Millisecond
+			fakeModems(c)
+
+			// Fail twice and then succeed.
+			var calls int
+			c.signal = func(_ *modemmanager.Modem, _ context.Context) (*modemmanager.Signal, error) {
+				calls++
+				if calls <= 2 {
+					return nil, tt.err
+				}
+
+				return &modemmanager.Signal{}, nil
+			}
+
+			d := c.collect(context.Background(), &modemmanager.Modem{DeviceIdentifier: "foo"})
+			if tt.ok && d.err != nil {
+				t.Fatalf("failed to collect modem data: %v", d.err)
+			}
+			if !tt.ok && d.err == nil {
+				t.Fatal("expected an error, but none occurred")
+			}
+
+			if calls != tt.calls {
+				t.Fatalf("unexpected number of calls: want %d, got %d", tt.calls, calls)
+			}
+		})
+	}
+}
+
+func TestCollectorFilter(t *testing.T) {
+	tests := []struct {
+		name             string
+		include, exclude *regexp.Regexp
+		want             []string
+	}{
+		{
+			name: "all",
+			want: []string{"bar", "baz", "foo"},
+		},
+		{
+			name:    "include",
+			include: regexp.MustCompile(`^(?:foo|ba.)$`),
+			want:    []string{"bar", "baz", "foo"},
+		},
+		{
+			name:    "exclude",
+			exclude: regexp.MustCompile(`^(?:baz)$`),
+			want:    []string{"bar", "foo"},
+		},
+		{
+			name:    "include and exclude",
+			include: regexp.MustCompile(`^(?:ba.)$`),
+			exclude: regexp.MustCompile(`^(?:baz)$`),
+			want:    []string{"bar"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testCollector(&Config{
+				IncludeModems: tt.include,
+				ExcludeModems: tt.exclude,
+			})
+
+			var got []string
+			for _, id := range []string{"bar", "baz", "foo"} {
+				if c.filter(id) {
+					got = append(got, id)
+				}
+			}
+
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Fatalf("unexpected exported modems (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCollectorSignalSetup(t *testing.T) {
+	c := testCollector(&Config{SignalRate: 5 * time.Second})
+	fakeModems(c)
+
+	// Each scrape visits the modems in the current slice, and a new modem
+	// appears after the first scrape.
+	modems := []*modemmanager.Modem{{Index: 0, DeviceIdentifier: "foo"}}
+	c.forEachModem = func(ctx context.Context, fn func(context.Context, *modemmanager.Modem) error) error {
+		for _, m := range modems {
+			if err := fn(ctx, m); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	// The fake runs on a collector goroutine, so record the rates rather than
+	// failing the test there.
+	var (
+		setup []string
+		rates []time.Duration
+	)
+	c.signalSetup = func(m *modemmanager.Modem, _ context.Context, rate time.Duration) error {
+		rates = append(rates, rate)
+		setup = append(setup, m.DeviceIdentifier)
+		if m.DeviceIdentifier == "bar" {
+			return errors.New("permission denied")
+		}
+
+		return nil
+	}
+
+	mm := metricslite.NewMemory()
+	c.register(mm)
+	mm.OnConstScrape(c.onScrape)
+
+	_ = mm.Series()
+	modems = append(modems, &modemmanager.Modem{Index: 1, DeviceIdentifier: "bar"})
+	got := series(mm)
+
+	if diff := cmp.Diff([]string{"foo", "bar"}, setup); diff != "" {
+		t.Fatalf("unexpected modems configured (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]time.Duration{5 * time.Second, 5 * time.Second}, rates); diff != "" {
+		t.Fatalf("unexpected signal rates (-want +got):\n%s", diff)
+	}
+
+	wantOK := map[string]float64{
+		"device_id=bar": 0,
+		"device_id=foo": 1,
+	}
+
+	if diff := cmp.Diff(wantOK, got[mmModemSignalSetupOK].Samples); diff != "" {
+		t.Fatalf("unexpected signal setup OK samples (-want +got):\n%s", diff)
+	}
+
+	wantRate := map[string]float64{
+		"device_id=bar": 5,
+		"device_id=foo": 5,
+	}
+
+	if diff := cmp.Diff(wantRate, got[mmModemSignalSetupRate].Samples); diff != "" {
+		t.Fatalf("unexpected signal setup rate samples (-want +got):\n%s", diff)
+	}
+
+	if diff := cmp.Diff(map[string]float64{"": 5}, got[mmSignalRefreshRate].Samples); diff != "" {
+		t.Fatalf("unexpected signal refresh rate samples (-want +got):\n%s", diff)
+	}
+
+	// Modem bar failed setup during the second scrape.
+	wantErrors := map[string]float64{"": 1}
+
+	if diff := cmp.Diff(wantErrors, got[mmScrapeErrors].Samples); diff != "" {
+		t.Fatalf("unexpected scrape errors samples (-want +got):\n%s", diff)
+	}
+}
+
+// testCollector creates a collector using cfg which must not be used to query
+// ModemManager unless its functions are swapped out.
+func testCollector(cfg *Config) *collector {
+	return newCollector(&modemmanager.Client{}, cfg)
+}
+
+// fakeModems configures c to visit each of modems during a scrape, returning
+// canned data for each modem.
+func fakeModems(c *collector, modems ...*modemmanager.Modem) {
+	c.forEachModem = func(ctx context.Context, fn func(context.Context, *modemmanager.Modem) error) error {
+		for _, m := range modems {
+			if err := fn(ctx, m); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+	c.signalSetup = func(_ *modemmanager.Modem, _ context.Context, _ time.Duration) error {
+		return nil
+	}
+	c.networkTime = func(_ *modemmanager.Modem, _ context.Context) (time.Time, error) {
+		return time.Unix(1, 0), nil
+	}
+	c.signal = func(_ *modemmanager.Modem, _ context.Context) (*modemmanager.Signal, error) {
+		return &modemmanager.Signal{}, nil
+	}
+	c.bearers = func(_ *modemmanager.Modem, _ context.Context) ([]*modemmanager.Bearer, error) {
+		return nil, nil
+	}
+}
+
+// mustCIDR parses s as an IP address and prefix or panics.
+func mustCIDR(s string) *net.IPNet {
+	ip, ipn, err := net.ParseCIDR(s)
+	if err != nil {
+		panicf("failed to parse CIDR: %v", err)
+	}
+	ipn.IP = ip
+
+	return ipn
+}
+
+// series produces the timeseries from mm with metric names and help strings
+// cleared from the output so we can more concisely test the sample data.
+func series(mm *metricslite.Memory) map[string]metricslite.Series {
+	got := mm.Series()
+	for k, v := range got {
+		v.Name = ""
+		v.Help = ""
+		got[k] = v
+	}
+
+	return got
 }
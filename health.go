@@ -0,0 +1,51 @@
+package modemmanagerexporter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/mdlayher/modemmanager"
+)
+
+var _ http.Handler = &healthHandler{}
+
+// A healthHandler is an http.Handler which reports whether ModemManager is
+// reachable over D-Bus.
+type healthHandler struct {
+	timeout time.Duration
+
+	// A function which normally queries ModemManager but is also swappable
+	// for tests.
+	modem func(ctx context.Context, index int) (*modemmanager.Modem, error)
+}
+
+// NewHealthHandler returns an http.Handler which reports whether ModemManager
+// is reachable using a ModemManager client. The handler responds with HTTP 200
+// when ModemManager answers a query over D-Bus, and HTTP 503 otherwise.
+func NewHealthHandler(c *modemmanager.Client) http.Handler {
+	return &healthHandler{
+		timeout: defaultTimeout,
+		modem:   newClient(c).Modem,
+	}
+}
+
+// ServeHTTP implements http.Handler.
+func (h *healthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), h.timeout)
+	defer cancel()
+
+	// Fetching the first modem is a lightweight query. If no modems are
+	// present ModemManager reports that the modem does not exist, which still
+	// indicates that the daemon is reachable.
+	if _, err := h.modem(ctx, 0); err != nil && !errors.Is(err, os.ErrNotExist) {
+		http.Error(w, fmt.Sprintf("ModemManager is unreachable: %v", err), http.StatusServiceUnavailable)
+		return
+	}
+
+	_, _ = io.WriteString(w, "OK\n")
+}
@@ -0,0 +1,59 @@
+package modemmanagerexporter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mdlayher/modemmanager"
+)
+
+func TestHealthHandler(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		status int
+	}{
+		{
+			name:   "OK",
+			status: http.StatusOK,
+		},
+		{
+			name:   "no modems",
+			err:    fmt.Errorf("no modem: %w", os.ErrNotExist),
+			status: http.StatusOK,
+		},
+		{
+			name:   "unreachable",
+			err:    errors.New("D-Bus failure"),
+			status: http.StatusServiceUnavailable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &healthHandler{
+				timeout: time.Second,
+				modem: func(_ context.Context, index int) (*modemmanager.Modem, error) {
+					if index != 0 {
+						t.Fatalf("unexpected modem index: %d", index)
+					}
+
+					return &modemmanager.Modem{Index: index}, tt.err
+				},
+			}
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+			if w.Code != tt.status {
+				t.Fatalf("unexpected HTTP status: want %d, got %d", tt.status, w.Code)
+			}
+		})
+	}
+}
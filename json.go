@@ -0,0 +1,135 @@
+package modemmanagerexporter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+var _ http.Handler = &jsonHandler{}
+
+// A jsonHandler is an http.Handler which serves the data gathered from each
+// modem as JSON.
+type jsonHandler struct {
+	c *collector
+}
+
+// JSONHandler returns an http.Handler which serves the data gathered by the
+// Exporter from each modem as a JSON array, for consumers which cannot parse
+// Prometheus metrics. If a cache interval is configured, the data is served
+// from the same cache as the metrics.
+func (e *Exporter) JSONHandler() http.Handler {
+	return &jsonHandler{c: e.c}
+}
+
+// A jsonModem is the JSON representation of a modem and its data.
+type jsonModem struct {
+	DeviceID     string      `json:"device_id"`
+	Manufacturer string      `json:"manufacturer"`
+	Model        string      `json:"model"`
+	State        string      `json:"state"`
+	Ports        []jsonPort  `json:"ports"`
+	Signal       *jsonSignal `json:"signal,omitempty"`
+	Error        string      `json:"error,omitempty"`
+}
+
+// A jsonPort is the JSON representation of a modem port.
+type jsonPort struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// A jsonSignal is the JSON representation of a modem's extended signal
+// strength data.
+type jsonSignal struct {
+	LTE struct {
+		RSRP float64 `json:"rsrp_dbm"`
+		RSRQ float64 `json:"rsrq_db"`
+		RSSI float64 `json:"rssi_dbm"`
+		SNR  float64 `json:"snr_db"`
+	} `json:"lte"`
+}
+
+// ServeHTTP implements http.Handler.
+func (h *jsonHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var (
+		modems []jsonModem
+		err    error
+	)
+	if h.c.cacheInterval > 0 {
+		cs := h.c.cached()
+		modems, err = cs.modems, cs.err
+	} else {
+		modems, err = h.c.jsonModems(r.Context())
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to gather data from ModemManager: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(modems)
+}
+
+// jsonModems gathers data from each modem and returns its JSON representation.
+// Unlike a scrape, the state tracked for each modem across scrapes is not
+// updated.
+func (c *collector) jsonModems(ctx context.Context) ([]jsonModem, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.scrapeTimeout())
+	defer cancel()
+
+	// Always return an array, even if no modems are present.
+	modems := make([]jsonModem, 0)
+	_, err := c.forEachModemData(ctx, func(d *modemData) {
+		modems = append(modems, c.jsonModem(d))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return modems, nil
+}
+
+// jsonModem converts the data gathered from a modem to its JSON
+// representation, using the same values as the exported metric labels.
+func (c *collector) jsonModem(d *modemData) jsonModem {
+	id := c.modemID(d.m)
+
+	jm := jsonModem{
+		DeviceID:     id,
+		Manufacturer: d.m.Manufacturer,
+		Model:        d.m.Model,
+		Ports:        make([]jsonPort, 0, len(d.m.Ports)),
+	}
+
+	for _, s := range modemStates {
+		if s.st == d.m.State {
+			jm.State = s.s
+			break
+		}
+	}
+
+	for _, p := range d.m.Ports {
+		jm.Ports = append(jm.Ports, jsonPort{
+			Name: p.Name,
+			Type: portType(p.Type),
+		})
+	}
+
+	if d.err != nil {
+		jm.Error = d.err.Error()
+		return jm
+	}
+
+	if d.s != nil && !d.invalidSignal {
+		var s jsonSignal
+		s.LTE.RSRP = d.s.LTE.RSRP
+		s.LTE.RSRQ = d.s.LTE.RSRQ
+		s.LTE.RSSI = d.s.LTE.RSSI
+		s.LTE.SNR = d.s.LTE.SNR
+		jm.Signal = &s
+	}
+
+	return jm
+}
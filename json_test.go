@@ -0,0 +1,169 @@
+package modemmanagerexporter
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mdlayher/modemmanager"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestJSONHandler(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		body   string
+	}{
+		{
+			name:   "OK",
+			status: http.StatusOK,
+			body: `[{"device_id":"foo","manufacturer":"Test Manufacturer","model":"Test Modem","state":"connected",` +
+				`"ports":[{"name":"wwan0","type":"net"},{"name":"cdc-wdm0","type":"mbim"}],` +
+				`"signal":{"lte":{"rsrp_dbm":-116,"rsrq_db":-17,"rssi_dbm":-81,"snr_db":1}}}]` + "\n",
+		},
+		{
+			name:   "modem error",
+			err:    errors.New("D-Bus failure"),
+			status: http.StatusOK,
+			body: `[{"device_id":"foo","manufacturer":"Test Manufacturer","model":"Test Modem","state":"connected",` +
+				`"ports":[{"name":"wwan0","type":"net"},{"name":"cdc-wdm0","type":"mbim"}],` +
+				`"error":"failed to get signal strength: D-Bus failure"}]` + "\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testCollector(nil)
+			fakeModems(c, &modemmanager.Modem{
+				DeviceIdentifier: "foo",
+				Manufacturer:     "Test Manufacturer",
+				Model:            "Test Modem",
+				State:            modemmanager.StateConnected,
+				Ports: []modemmanager.Port{
+					{Name: "wwan0", Type: modemmanager.PortTypeNet},
+					{Name: "cdc-wdm0", Type: modemmanager.PortTypeMBIM},
+				},
+			})
+			c.signal = func(_ *modemmanager.Modem, _ context.Context) (*modemmanager.Signal, error) {
+				if tt.err != nil {
+					return nil, tt.err
+				}
+
+				var s modemmanager.Signal
+				s.LTE.RSRP = -116
+				s.LTE.RSRQ = -17
+				s.LTE.RSSI = -81
+				s.LTE.SNR = 1
+				return &s, nil
+			}
+
+			w := httptest.NewRecorder()
+			(&jsonHandler{c: c}).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/modems.json", nil))
+
+			if w.Code != tt.status {
+				t.Fatalf("unexpected HTTP status: want %d, got %d", tt.status, w.Code)
+			}
+
+			if diff := cmp.Diff(tt.body, w.Body.String()); diff != "" {
+				t.Fatalf("unexpected JSON body (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestJSONHandlerScrapeError(t *testing.T) {
+	c := testCollector(nil)
+	c.forEachModem = func(_ context.Context, _ func(context.Context, *modemmanager.Modem) error) error {
+		return errors.New("D-Bus failure")
+	}
+
+	w := httptest.NewRecorder()
+	(&jsonHandler{c: c}).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/modems.json", nil))
+
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("unexpected HTTP status: want %d, got %d", http.StatusInternalServerError, w.Code)
+	}
+}
+
+func TestExporterSharedState(t *testing.T) {
+	c := testCollector(&Config{SignalRate: 5 * time.Second})
+	fakeModems(c, &modemmanager.Modem{DeviceIdentifier: "foo"})
+
+	var setup int
+	c.signalSetup = func(_ *modemmanager.Modem, _ context.Context, _ time.Duration) error {
+		setup++
+		return nil
+	}
+
+	// Both handlers share the exporter's collector, so the modem is only
+	// configured once.
+	e := &Exporter{c: c}
+	for _, h := range []http.Handler{e.JSONHandler(), e.Handler(prometheus.NewRegistry())} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("unexpected HTTP status: want %d, got %d", http.StatusOK, w.Code)
+		}
+	}
+
+	if setup != 1 {
+		t.Fatalf("expected modem to be configured once, but got %d", setup)
+	}
+}
+
+func TestJSONHandlerScrapeState(t *testing.T) {
+	c := testCollector(&Config{SignalWindow: 2})
+	fakeModems(c, &modemmanager.Modem{
+		DeviceIdentifier: "foo",
+		State:            modemmanager.StateConnected,
+	})
+	c.signal = func(_ *modemmanager.Modem, _ context.Context) (*modemmanager.Signal, error) {
+		var s modemmanager.Signal
+		s.LTE.RSRP = -100
+		return &s, nil
+	}
+
+	// JSON requests do not track the modem's state across scrapes, so they do
+	// not add samples to its signal window.
+	h := (&Exporter{c: c}).JSONHandler()
+	for i := 0; i < 2; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/modems.json", nil))
+	}
+
+	if len(c.modems) != 0 {
+		t.Fatalf("expected no modem state, but got: %v", c.modems)
+	}
+}
+
+func TestJSONHandlerCache(t *testing.T) {
+	c := testCollector(&Config{CacheInterval: time.Minute})
+	fakeModems(c)
+
+	var polls int
+	c.forEachModem = func(ctx context.Context, fn func(context.Context, *modemmanager.Modem) error) error {
+		polls++
+		return fn(ctx, &modemmanager.Modem{DeviceIdentifier: "foo"})
+	}
+
+	// The JSON and metrics handlers are served from the same cached scrape.
+	e := &Exporter{c: c}
+	for _, h := range []http.Handler{e.JSONHandler(), e.Handler(prometheus.NewRegistry()), e.JSONHandler()} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("unexpected HTTP status: want %d, got %d", http.StatusOK, w.Code)
+		}
+	}
+
+	if polls != 1 {
+		t.Fatalf("expected modems to be polled once, but got: %d", polls)
+	}
+}
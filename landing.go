@@ -0,0 +1,82 @@
+package modemmanagerexporter
+
+import (
+	"context"
+	"html/template"
+	"net/http"
+	"time"
+
+	"github.com/mdlayher/modemmanager"
+)
+
+var _ http.Handler = &landingHandler{}
+
+// landingTemplate is the HTML landing page served by a landingHandler.
+var landingTemplate = template.Must(template.New("landing").Parse(`<!DOCTYPE html>
+<html>
+<head><title>ModemManager Exporter</title></head>
+<body>
+<h1>ModemManager Exporter</h1>
+<p>Version: {{.Version}}</p>
+<p>Modems: {{if .Err}}unknown ({{.Err}}){{else}}{{.Modems}}{{end}}</p>
+<p><a href="{{.Path}}">Metrics</a></p>
+</body>
+</html>
+`))
+
+// A landingHandler is an http.Handler which serves an HTML landing page for
+// the exporter.
+type landingHandler struct {
+	path    string
+	version string
+	timeout time.Duration
+
+	// A function which normally queries ModemManager but is also swappable
+	// for tests.
+	forEachModem func(ctx context.Context, fn func(ctx context.Context, m *modemmanager.Modem) error) error
+}
+
+// NewLandingHandler returns an http.Handler which serves an HTML landing page
+// with the exporter's build version and revision, a link to the metrics at
+// path, and the number of modems detected using a ModemManager client.
+func NewLandingHandler(c *modemmanager.Client, path, version, revision string) http.Handler {
+	return &landingHandler{
+		path:         path,
+		version:      version + " (revision: " + revision + ")",
+		timeout:      defaultTimeout,
+		forEachModem: newClient(c).ForEachModem,
+	}
+}
+
+// ServeHTTP implements http.Handler.
+func (h *landingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), h.timeout)
+	defer cancel()
+
+	var n int
+	err := h.forEachModem(ctx, func(_ context.Context, _ *modemmanager.Modem) error {
+		n++
+		return nil
+	})
+
+	// Report any error on the page itself so the exporter's version and
+	// metrics link remain accessible while ModemManager is unavailable.
+	data := struct {
+		Path, Version string
+		Modems        int
+		Err           error
+	}{
+		Path:    h.path,
+		Version: h.version,
+		Modems:  n,
+		Err:     err,
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_ = landingTemplate.Execute(w, data)
+}
@@ -0,0 +1,55 @@
+package modemmanagerexporter
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mdlayher/modemmanager"
+)
+
+func TestLandingHandler(t *testing.T) {
+	h := &landingHandler{
+		path:    "/metrics",
+		version: "v1.0.0",
+		timeout: time.Second,
+		forEachModem: func(ctx context.Context, fn func(context.Context, *modemmanager.Modem) error) error {
+			for _, id := range []string{"foo", "bar"} {
+				if err := fn(ctx, &modemmanager.Modem{DeviceIdentifier: id}); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		},
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected HTTP status: want %d, got %d", http.StatusOK, w.Code)
+	}
+
+	body := w.Body.String()
+	for _, want := range []string{
+		"Version: v1.0.0",
+		"Modems: 2",
+		`<a href="/metrics">`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("expected %q in landing page:\n%s", want, body)
+		}
+	}
+
+	// Unknown paths are not served the landing page.
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/foo", nil))
+
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("unexpected HTTP status: want %d, got %d", http.StatusNotFound, w.Code)
+	}
+}